@@ -0,0 +1,518 @@
+// Package address parses Terraform resource addresses into their module and
+// resource steps, so that they can be compared and rewritten segment by segment
+package address
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	ModeManaged = "managed"
+	ModeData    = "data"
+)
+
+// Key is the instance key of a module call or a resource,
+// an integer when created by count and a string when created by for_each
+type Key struct {
+	IsString bool
+	Int      int
+	Str      string
+
+	// Wildcard keys only appear in patterns and match any key
+	Wildcard bool
+}
+
+func IntKey(index int) *Key {
+	return &Key{Int: index}
+}
+
+func StringKey(key string) *Key {
+	return &Key{IsString: true, Str: key}
+}
+
+// Value returns the key the way it is stored as index_key in the state
+func (k Key) Value() interface{} {
+	if k.IsString {
+		return k.Str
+	}
+	return k.Int
+}
+
+func (k Key) String() string {
+	if k.Wildcard {
+		return "[*]"
+	}
+	if k.IsString {
+		return "[" + Quote(k.Str) + "]"
+	}
+	return fmt.Sprintf("[%d]", k.Int)
+}
+
+func keysEqual(a *Key, b *Key) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// Step is either a module call or a resource, with an optional instance key
+type Step struct {
+	Module bool
+	Mode   string
+	Type   string
+	Name   string
+	Key    *Key
+}
+
+func (s Step) String() string {
+	var name string
+	switch {
+	case s.Module:
+		name = "module." + s.Name
+	case s.Mode == ModeData:
+		name = "data." + s.Type + "." + s.Name
+	default:
+		name = s.Type + "." + s.Name
+	}
+	if s.Key != nil {
+		name += s.Key.String()
+	}
+	return name
+}
+
+// sameObject checks that two steps name the same module call or resource, regardless of keys
+func (s Step) sameObject(other Step) bool {
+	return s.Module == other.Module && s.Mode == other.Mode && s.Type == other.Type && s.Name == other.Name
+}
+
+// Address is a module path optionally followed by a resource. Addresses without
+// instance keys stand for every instance of the module or resource.
+type Address struct {
+	Steps []Step
+}
+
+func (a Address) String() string {
+	parts := make([]string, 0, len(a.Steps))
+	for _, step := range a.Steps {
+		parts = append(parts, step.String())
+	}
+	return strings.Join(parts, ".")
+}
+
+// Resource returns the resource step, or nil when the address only points at a module
+func (a Address) Resource() *Step {
+	if len(a.Steps) == 0 || a.Steps[len(a.Steps)-1].Module {
+		return nil
+	}
+	return &a.Steps[len(a.Steps)-1]
+}
+
+// ModulePath returns the module steps of the address
+func (a Address) ModulePath() Address {
+	if a.Resource() != nil {
+		return Address{Steps: a.Steps[:len(a.Steps)-1]}
+	}
+	return a
+}
+
+// HasKeys tells if any step of the address selects a single instance
+func (a Address) HasKeys() bool {
+	for _, step := range a.Steps {
+		if step.Key != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains checks if other is the same as, or nested inside, this address.
+// A step without a key contains every instance of that step.
+func (a Address) Contains(other Address) bool {
+	if len(a.Steps) == 0 || len(a.Steps) > len(other.Steps) {
+		return false
+	}
+	for i, step := range a.Steps {
+		if !step.sameObject(other.Steps[i]) {
+			return false
+		}
+		if step.Key != nil && !keysEqual(step.Key, other.Steps[i].Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rewrite moves an address contained in from to the same place under to. The
+// instance key of the last matched step is carried over when neither from nor
+// to spell one out, so module.a[0].x rewritten from module.a to module.b
+// becomes module.b[0].x
+func (a Address) Rewrite(from Address, to Address) (Address, error) {
+	if !from.Contains(a) {
+		return Address{}, fmt.Errorf("address %s is not part of %s", a, from)
+	}
+	if len(to.Steps) == 0 || to.Steps[len(to.Steps)-1].Module != from.Steps[len(from.Steps)-1].Module {
+		return Address{}, fmt.Errorf("address %s cannot be moved to %s", from, to)
+	}
+
+	steps := make([]Step, 0, len(to.Steps)+len(a.Steps)-len(from.Steps))
+	steps = append(steps, to.Steps...)
+
+	last := len(from.Steps) - 1
+	if from.Steps[last].Key == nil && steps[len(steps)-1].Key == nil {
+		steps[len(steps)-1].Key = a.Steps[last].Key
+	}
+
+	steps = append(steps, a.Steps[len(from.Steps):]...)
+	return Address{Steps: steps}, nil
+}
+
+type parser struct {
+	input     string
+	position  int
+	wildcards bool
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid address %s at position %d: %s", p.input, p.position, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) done() bool {
+	return p.position >= len(p.input)
+}
+
+func (p *parser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.position]
+}
+
+func (p *parser) identifier() (string, error) {
+	start := p.position
+	for !p.done() {
+		char := rune(p.input[p.position])
+		if char == '_' || char == '-' || unicode.IsLetter(char) || (p.position > start && unicode.IsDigit(char)) ||
+			(p.wildcards && char == '*') {
+			p.position++
+			continue
+		}
+		break
+	}
+	if start == p.position {
+		return "", p.errorf("expected a name")
+	}
+	return p.input[start:p.position], nil
+}
+
+func (p *parser) dot() error {
+	if p.peek() != '.' {
+		return p.errorf("expected a dot")
+	}
+	p.position++
+	return nil
+}
+
+func (p *parser) key() (*Key, error) {
+	if p.peek() != '[' {
+		return nil, nil
+	}
+	p.position++
+
+	var key *Key
+	if p.wildcards && (p.peek() == '*' || strings.HasPrefix(p.input[p.position:], `"*"`)) {
+		p.position += strings.Index(p.input[p.position:], "*") + 1
+		if p.peek() == '"' {
+			p.position++
+		}
+		key = &Key{Wildcard: true}
+	} else if p.peek() == '"' {
+		value, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		key = StringKey(value)
+	} else {
+		start := p.position
+		for !p.done() && p.input[p.position] >= '0' && p.input[p.position] <= '9' {
+			p.position++
+		}
+		index, err := strconv.Atoi(p.input[start:p.position])
+		if err != nil {
+			return nil, p.errorf("expected a number or a quoted string as key")
+		}
+		key = IntKey(index)
+	}
+
+	if p.peek() != ']' {
+		return nil, p.errorf("expected a closing bracket")
+	}
+	p.position++
+	return key, nil
+}
+
+func (p *parser) quoted() (string, error) {
+	// Skip the opening quote
+	p.position++
+	value := strings.Builder{}
+
+	for !p.done() {
+		char := p.input[p.position]
+		switch {
+		case char == '"':
+			p.position++
+			return value.String(), nil
+		case char == '\\':
+			if p.position+1 >= len(p.input) {
+				return "", p.errorf("unterminated escape sequence")
+			}
+			escaped := p.input[p.position+1]
+			p.position += 2
+			switch escaped {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case '"', '\\':
+				value.WriteByte(escaped)
+			case 'u', 'U':
+				length := 4
+				if escaped == 'U' {
+					length = 8
+				}
+				if p.position+length > len(p.input) {
+					return "", p.errorf("unterminated unicode escape")
+				}
+				code, err := strconv.ParseUint(p.input[p.position:p.position+length], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				value.WriteRune(rune(code))
+				p.position += length
+			default:
+				return "", p.errorf("unknown escape sequence \\%c", escaped)
+			}
+		case strings.HasPrefix(p.input[p.position:], "$${"), strings.HasPrefix(p.input[p.position:], "%%{"):
+			value.WriteString(p.input[p.position+1 : p.position+3])
+			p.position += 3
+		default:
+			value.WriteByte(char)
+			p.position++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *parser) step() (Step, error) {
+	first, err := p.identifier()
+	if err != nil {
+		return Step{}, err
+	}
+
+	step := Step{Mode: ModeManaged}
+	switch first {
+	case "module":
+		step = Step{Module: true}
+		if err := p.dot(); err != nil {
+			return step, err
+		}
+		if step.Name, err = p.identifier(); err != nil {
+			return step, err
+		}
+	case "data":
+		step.Mode = ModeData
+		if err := p.dot(); err != nil {
+			return step, err
+		}
+		if step.Type, err = p.identifier(); err != nil {
+			return step, err
+		}
+		fallthrough
+	default:
+		if step.Type == "" {
+			step.Type = first
+		}
+		if err := p.dot(); err != nil {
+			return step, err
+		}
+		if step.Name, err = p.identifier(); err != nil {
+			return step, err
+		}
+	}
+
+	step.Key, err = p.key()
+	return step, err
+}
+
+// Parse reads an address such as module.db["primary"].aws_db_instance.this[0]
+func Parse(input string) (Address, error) {
+	return parse(&parser{input: strings.TrimSpace(input)})
+}
+
+// ParsePattern reads an address in which names may contain * wildcards
+// and keys may be [*] or ["*"], such as module.*.aws_iam_role.app_*
+func ParsePattern(input string) (Address, error) {
+	return parse(&parser{input: strings.TrimSpace(input), wildcards: true})
+}
+
+func parse(p *parser) (Address, error) {
+	steps := make([]Step, 0)
+
+	for {
+		step, err := p.step()
+		if err != nil {
+			return Address{}, err
+		}
+		if len(steps) > 0 && !steps[len(steps)-1].Module {
+			return Address{}, p.errorf("a resource cannot contain %s", step)
+		}
+		steps = append(steps, step)
+
+		if p.done() {
+			return Address{Steps: steps}, nil
+		}
+		if err := p.dot(); err != nil {
+			return Address{}, err
+		}
+	}
+}
+
+// IsPattern tells if the address contains any wildcard
+func (a Address) IsPattern() bool {
+	for _, step := range a.Steps {
+		if strings.Contains(step.Type+step.Name, "*") || (step.Key != nil && step.Key.Wildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern string, value string) ([]string, bool) {
+	if !strings.Contains(pattern, "*") {
+		return nil, pattern == value
+	}
+
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	matches := regexp.MustCompile("^" + strings.Join(parts, "(.*?)") + "$").FindStringSubmatch(value)
+	if matches == nil {
+		return nil, false
+	}
+	return matches[1:], true
+}
+
+// Match checks if other is contained in the pattern. It returns the part of
+// other that the pattern covers, with the wildcards filled in, and the text
+// matched by every wildcard in order of appearance
+func (a Address) Match(other Address) (Address, []string, bool) {
+	if len(a.Steps) == 0 || len(a.Steps) > len(other.Steps) {
+		return Address{}, nil, false
+	}
+
+	captures := make([]string, 0)
+	matched := make([]Step, 0, len(a.Steps))
+	for i, step := range a.Steps {
+		candidate := other.Steps[i]
+		if step.Module != candidate.Module || step.Mode != candidate.Mode {
+			return Address{}, nil, false
+		}
+		for _, field := range [][2]string{{step.Type, candidate.Type}, {step.Name, candidate.Name}} {
+			fieldCaptures, ok := globMatch(field[0], field[1])
+			if !ok {
+				return Address{}, nil, false
+			}
+			captures = append(captures, fieldCaptures...)
+		}
+
+		concrete := candidate
+		switch {
+		case step.Key == nil:
+			concrete.Key = nil
+		case step.Key.Wildcard:
+			if candidate.Key == nil {
+				return Address{}, nil, false
+			}
+			capture := strconv.Itoa(candidate.Key.Int)
+			if candidate.Key.IsString {
+				capture = strings.TrimSuffix(strings.TrimPrefix(Quote(candidate.Key.Str), `"`), `"`)
+			}
+			captures = append(captures, capture)
+		case !keysEqual(step.Key, candidate.Key):
+			return Address{}, nil, false
+		}
+		matched = append(matched, concrete)
+	}
+	return Address{Steps: matched}, captures, true
+}
+
+var captureReference = regexp.MustCompile(`\$(\d+)|\$\{(\d+)\}`)
+
+// Expand replaces the $1 or ${1} references in template with the captures of a Match
+func Expand(template string, captures []string) (string, error) {
+	var err error
+	expanded := captureReference.ReplaceAllStringFunc(template, func(reference string) string {
+		groups := captureReference.FindStringSubmatch(reference)
+		index, _ := strconv.Atoi(groups[1] + groups[2])
+		if index < 1 || index > len(captures) {
+			err = fmt.Errorf("%s refers to %s, but only %d wildcards were matched", template, reference, len(captures))
+			return reference
+		}
+		return captures[index-1]
+	})
+	return expanded, err
+}
+
+// Quote renders a string the way Terraform renders string keys in addresses
+func Quote(value string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`,
+		"${", "$${",
+		"%{", "%%{",
+	)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// Unquote reads a string quoted by Quote, or by Terraform in addresses and configuration
+func Unquote(quoted string) (string, error) {
+	p := &parser{input: strings.TrimSpace(quoted)}
+	if p.peek() != '"' {
+		return "", p.errorf("expected a quoted string")
+	}
+	value, err := p.quoted()
+	if err == nil && !p.done() {
+		return "", p.errorf("unexpected characters after the quoted string")
+	}
+	return value, err
+}
+
+// Cut splits input around the first separator that is not inside an instance key
+func Cut(input string, separator byte) (string, string, bool) {
+	inBracket, inQuote := false, false
+	for i := 0; i < len(input); i++ {
+		char := input[i]
+		switch {
+		case inQuote && char == '\\':
+			i++
+		case char == '"' && inBracket:
+			inQuote = !inQuote
+		case char == '[' && !inQuote:
+			inBracket = true
+		case char == ']' && !inQuote:
+			inBracket = false
+		case char == separator && !inBracket:
+			return input[:i], input[i+1:], true
+		}
+	}
+	return input, "", false
+}
@@ -0,0 +1,147 @@
+package address_test
+
+import (
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParse(t *testing.T, input string) address.Address {
+	parsed, err := address.Parse(input)
+	assert.Nil(t, err, input)
+	return parsed
+}
+
+func TestParse(t *testing.T) {
+	for _, input := range []string{
+		"module.db",
+		"module.table_count[0]",
+		`module.table_foreach["1"].aws_dynamodb_table.this`,
+		`aws_secretsmanager_secret.iterate_foreach["one"]`,
+		"module.a.module.b[2].data.aws_iam_policy_document.this",
+		`aws_s3_bucket.this["it's \"quoted\"\n"]`,
+		`aws_s3_bucket.this["$${literal}"]`,
+	} {
+		assert.Equal(t, input, mustParse(t, input).String())
+	}
+
+	parsed := mustParse(t, `module.svc["a.b"].aws_iam_role.this[3]`)
+	assert.Len(t, parsed.Steps, 2)
+	assert.Equal(t, "a.b", parsed.Steps[0].Key.Str)
+	assert.Equal(t, 3, parsed.Resource().Key.Int)
+	assert.Equal(t, `module.svc["a.b"]`, parsed.ModulePath().String())
+
+	escaped := mustParse(t, `aws_s3_bucket.this["é\\"]`)
+	assert.Equal(t, "é\\", escaped.Resource().Key.Str)
+
+	for _, input := range []string{
+		"",
+		"module",
+		"aws_s3_bucket",
+		"aws_s3_bucket.this.module.db",
+		`module.db["unterminated]`,
+		"module.db[one]",
+	} {
+		_, err := address.Parse(input)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestAddress_Contains(t *testing.T) {
+	db := mustParse(t, "module.db")
+	assert.True(t, db.Contains(mustParse(t, "module.db")))
+	assert.True(t, db.Contains(mustParse(t, "module.db[0].aws_db_instance.this")))
+	assert.False(t, db.Contains(mustParse(t, "module.db_replica.aws_db_instance.this")))
+
+	logs := mustParse(t, "aws_s3_bucket.logs")
+	assert.True(t, logs.Contains(mustParse(t, `aws_s3_bucket.logs["a"]`)))
+	assert.False(t, logs.Contains(mustParse(t, "aws_s3_bucket.logs_archive")))
+	assert.False(t, logs.Contains(mustParse(t, "data.aws_s3_bucket.logs")))
+
+	first := mustParse(t, "module.table_count[0]")
+	assert.True(t, first.Contains(mustParse(t, "module.table_count[0].aws_dynamodb_table.this")))
+	assert.False(t, first.Contains(mustParse(t, "module.table_count[1].aws_dynamodb_table.this")))
+}
+
+func TestAddress_Rewrite(t *testing.T) {
+	instance := mustParse(t, "module.db[0].aws_db_instance.this")
+
+	rewritten, err := instance.Rewrite(mustParse(t, "module.db"), mustParse(t, "module.database"))
+	assert.Nil(t, err)
+	assert.Equal(t, "module.database[0].aws_db_instance.this", rewritten.String())
+
+	rewritten, err = instance.Rewrite(mustParse(t, "module.db[0]"), mustParse(t, `module.database["primary"]`))
+	assert.Nil(t, err)
+	assert.Equal(t, `module.database["primary"].aws_db_instance.this`, rewritten.String())
+
+	rewritten, err = instance.Rewrite(mustParse(t, "module.db"), mustParse(t, "module.platform.module.db"))
+	assert.Nil(t, err)
+	assert.Equal(t, "module.platform.module.db[0].aws_db_instance.this", rewritten.String())
+
+	_, err = instance.Rewrite(mustParse(t, "module.db_replica"), mustParse(t, "module.database"))
+	assert.NotNil(t, err)
+
+	_, err = instance.Rewrite(mustParse(t, "module.db"), mustParse(t, "aws_db_instance.this"))
+	assert.NotNil(t, err)
+}
+
+func TestCut(t *testing.T) {
+	source, target, found := address.Cut(`aws_s3_bucket.this["a:b"]:aws_s3_bucket.that`, ':')
+	assert.True(t, found)
+	assert.Equal(t, `aws_s3_bucket.this["a:b"]`, source)
+	assert.Equal(t, "aws_s3_bucket.that", target)
+
+	_, _, found = address.Cut(`aws_s3_bucket.this["a:b"]`, ':')
+	assert.False(t, found)
+}
+
+func TestAddress_Match(t *testing.T) {
+	pattern, err := address.ParsePattern("module.*.aws_dynamodb_table.this")
+	assert.Nil(t, err)
+	assert.True(t, pattern.IsPattern())
+
+	topLevel, captures, matched := pattern.Match(mustParse(t, "module.orders[0].aws_dynamodb_table.this"))
+	assert.True(t, matched)
+	assert.Equal(t, "module.orders.aws_dynamodb_table.this", topLevel.String())
+	assert.Equal(t, []string{"orders"}, captures)
+
+	_, _, matched = pattern.Match(mustParse(t, "module.orders.aws_dynamodb_table.other"))
+	assert.False(t, matched)
+
+	pattern, _ = address.ParsePattern(`module.svc["*"]`)
+	topLevel, captures, matched = pattern.Match(mustParse(t, `module.svc["api"].aws_iam_role.this`))
+	assert.True(t, matched)
+	assert.Equal(t, `module.svc["api"]`, topLevel.String())
+	assert.Equal(t, []string{"api"}, captures)
+
+	pattern, _ = address.ParsePattern("module.app.aws_iam_role.role_*")
+	_, captures, matched = pattern.Match(mustParse(t, "module.app.aws_iam_role.role_reader"))
+	assert.True(t, matched)
+	assert.Equal(t, []string{"reader"}, captures)
+
+	literal, _ := address.ParsePattern("module.app")
+	assert.False(t, literal.IsPattern())
+}
+
+func TestUnquote(t *testing.T) {
+	for _, value := range []string{"plain", `it's "quoted"` + "\n", "${literal} %{directive}", `back\slash`} {
+		unquoted, err := address.Unquote(address.Quote(value))
+		assert.Nil(t, err)
+		assert.Equal(t, value, unquoted)
+	}
+
+	_, err := address.Unquote("unquoted")
+	assert.NotNil(t, err)
+	_, err = address.Unquote(`"one" "two"`)
+	assert.NotNil(t, err)
+}
+
+func TestExpand(t *testing.T) {
+	expanded, err := address.Expand(`module.platform["$1"].aws_iam_role.${2}`, []string{"api", "reader"})
+	assert.Nil(t, err)
+	assert.Equal(t, `module.platform["api"].aws_iam_role.reader`, expanded)
+
+	_, err = address.Expand("module.$2", []string{"api"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const batchImportFileName = "tfstate_transfer_imports.tf"
+
+type planDiagnostic struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail"`
+	Address  string `json:"address"`
+	Range    *struct {
+		Filename string `json:"filename"`
+		Start    struct {
+			Line int `json:"line"`
+		} `json:"start"`
+	} `json:"range"`
+}
+
+type plannedChange struct {
+	Resource struct {
+		Addr string `json:"addr"`
+	} `json:"resource"`
+	Action string `json:"action"`
+}
+
+type planMessage struct {
+	Type       string          `json:"type"`
+	Diagnostic *planDiagnostic `json:"diagnostic"`
+	Change     *plannedChange  `json:"change"`
+}
+
+// The planned actions that leave the infrastructure as it is
+const (
+	planActionImport = "import"
+	planActionNoop   = "noop"
+)
+
+// batchImportFile is the temporary configuration holding every import block,
+// remembering on which lines each block starts so diagnostics can be traced back
+type batchImportFile struct {
+	blocks    map[string]string
+	startLine map[int]string
+}
+
+func newBatchImportFile(importBlocks map[string]string) *batchImportFile {
+	file := &batchImportFile{blocks: make(map[string]string), startLine: make(map[int]string)}
+
+	line := strings.Count(generatedFileHeader, "\n") + 2
+	for _, targetName := range sortedKeys(importBlocks) {
+		file.blocks[targetName] = importBlocks[targetName]
+		file.startLine[line] = targetName
+		line += strings.Count(importBlocks[targetName], "\n") + 1
+	}
+	return file
+}
+
+func (f *batchImportFile) write(targetDir string) error {
+	return writeGeneratedFile(targetDir, batchImportFileName, sortedValues(f.blocks))
+}
+
+// addressForLine finds the import block that contains the given line
+func (f *batchImportFile) addressForLine(line int) string {
+	address, bestStart := "", 0
+	for start, targetName := range f.startLine {
+		if start <= line && start > bestStart {
+			address, bestStart = targetName, start
+		}
+	}
+	return address
+}
+
+// ParsePlanDiagnostics reads the machine-readable output of terraform plan/apply
+// and returns the error diagnostics
+func ParsePlanDiagnostics(output string) []planDiagnostic {
+	diagnostics := make([]planDiagnostic, 0)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var message planMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		if message.Type == "diagnostic" && message.Diagnostic != nil && message.Diagnostic.Severity == "error" {
+			diagnostics = append(diagnostics, *message.Diagnostic)
+		}
+	}
+	return diagnostics
+}
+
+// ParsePlannedChanges reads the machine-readable output of terraform plan
+// and returns the action planned for each resource
+func ParsePlannedChanges(output string) map[string]string {
+	changes := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var message planMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		if message.Type == "planned_change" && message.Change != nil {
+			changes[message.Change.Resource.Addr] = message.Change.Action
+		}
+	}
+	return changes
+}
+
+func diagnosticError(diagnostic planDiagnostic) error {
+	if diagnostic.Detail == "" {
+		return errors.New(diagnostic.Summary)
+	}
+	return fmt.Errorf("%s: %s", diagnostic.Summary, diagnostic.Detail)
+}
+
+// planBatchImport plans the remaining imports, dropping every import that a
+// diagnostic can be traced back to until the plan succeeds
+func planBatchImport(target Executor, importFile *batchImportFile, planFile string, failures map[string]error) error {
+	for len(importFile.blocks) > 0 {
+		if err := importFile.write(target.Dir()); err != nil {
+			return err
+		}
+
+		output, err := target.Plan(planFile, sortedKeys(importFile.blocks))
+		if err == nil {
+			dropped, err := dropChangingImports(importFile, ParsePlannedChanges(output), failures)
+			if err != nil || !dropped {
+				return err
+			}
+			continue
+		}
+
+		diagnostics := ParsePlanDiagnostics(output)
+		if len(diagnostics) == 0 {
+			return err
+		}
+
+		traced := 0
+		for _, diagnostic := range diagnostics {
+			address := diagnostic.Address
+			if diagnostic.Range != nil && filepath.Base(diagnostic.Range.Filename) == batchImportFileName {
+				address = importFile.addressForLine(diagnostic.Range.Start.Line)
+			}
+			if _, ok := importFile.blocks[address]; !ok {
+				continue
+			}
+			failures[address] = diagnosticError(diagnostic)
+			delete(importFile.blocks, address)
+			traced++
+		}
+
+		if traced == 0 {
+			// The plan fails for a reason unrelated to any single import
+			return diagnosticError(diagnostics[0])
+		}
+		importFile.startLine = newBatchImportFile(importFile.blocks).startLine
+	}
+	return nil
+}
+
+// dropChangingImports makes sure that applying the plan only imports: every import
+// that would also change its resource is dropped, and any other change, such as
+// drift on a dependency picked up by -target, fails the whole batch
+func dropChangingImports(importFile *batchImportFile, changes map[string]string, failures map[string]error) (bool, error) {
+	dropped := false
+	for _, address := range sortedKeys(changes) {
+		action := changes[address]
+		if action == planActionImport || action == planActionNoop {
+			continue
+		}
+		if _, ok := importFile.blocks[address]; !ok {
+			return false, fmt.Errorf("the plan would %s %s, refusing to apply anything but imports", action, address)
+		}
+		failures[address] = fmt.Errorf("the plan would %s the resource besides importing it, refusing to apply it", action)
+		delete(importFile.blocks, address)
+		dropped = true
+	}
+	if dropped {
+		importFile.startLine = newBatchImportFile(importFile.blocks).startLine
+	}
+	return dropped, nil
+}
+
+func listState(executor Executor) (map[string]bool, error) {
+	list, err := executor.StateList()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string]bool)
+	for _, address := range list {
+		addresses[address] = true
+	}
+	return addresses, nil
+}
+
+// runBatchImport imports every resource with a single plan and apply,
+// returning the outcome of each import keyed by the target name
+func runBatchImport(target Executor, importBlocks map[string]string) map[string]error {
+	failures := make(map[string]error)
+	importFile := newBatchImportFile(importBlocks)
+
+	defer func() {
+		_ = os.Remove(filepath.Join(target.Dir(), batchImportFileName))
+	}()
+
+	planDir, err := os.MkdirTemp("", "tfstate-transfer-")
+	if err != nil {
+		Panic(fmt.Sprintf("Failed to create a temporary directory: %v", err))
+	}
+	defer func() {
+		_ = os.RemoveAll(planDir)
+	}()
+	planFile := filepath.Join(planDir, "imports.tfplan")
+
+	batchErr := planBatchImport(target, importFile, planFile, failures)
+	if batchErr == nil && len(importFile.blocks) > 0 {
+		if output, err := target.Apply(planFile); err != nil {
+			batchErr = err
+			for _, diagnostic := range ParsePlanDiagnostics(output) {
+				if _, ok := importFile.blocks[diagnostic.Address]; ok {
+					failures[diagnostic.Address] = diagnosticError(diagnostic)
+				} else {
+					batchErr = diagnosticError(diagnostic)
+				}
+			}
+		}
+	}
+
+	// Whatever happened, the state tells which imports made it
+	imported, err := listState(target)
+	if err != nil {
+		imported = map[string]bool{}
+	}
+	for targetName := range importFile.blocks {
+		if imported[targetName] {
+			delete(failures, targetName)
+			continue
+		}
+		if failures[targetName] != nil {
+			continue
+		}
+		if batchErr != nil {
+			failures[targetName] = batchErr
+		} else {
+			failures[targetName] = errors.New("the resource was not imported by the batch apply")
+		}
+	}
+
+	results := make(map[string]error)
+	for targetName := range importBlocks {
+		results[targetName] = failures[targetName]
+	}
+	return results
+}
+
+func transferBatchImport(rn *RunHandler, source Executor, target Executor, dryRunSet map[string]*DryRunSet) {
+	requireFeature(target, FeatureImportBlocks)
+	resources := make([]*ImportObject, 0)
+	copies := make([]*ImportObject, 0)
+	importBlocks := make(map[string]string)
+
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		if resource.copyState {
+			copies = append(copies, resource)
+			continue
+		}
+
+		importBlock, err := importBlockFor(*resource)
+		if err != nil {
+			rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, err)
+			continue
+		}
+		importBlocks[resource.targetName] = importBlock
+		resources = append(resources, resource)
+	}
+
+	results := make(map[string]error)
+	if dryRunSet != nil {
+		for _, resource := range resources {
+			dryRunSet[resource.topLevelName].AddImportCommand(importBlocks[resource.targetName])
+		}
+		for _, dryRunEntry := range dryRunSet {
+			dryRunEntry.AddImportCommand(target.CommandLine(
+				append([]string{"apply", "-input=false"}, targetArguments(sortedKeys(importBlocks))...)...))
+		}
+	} else if len(importBlocks) > 0 {
+		results = runBatchImport(target, importBlocks)
+	}
+
+	for _, resource := range resources {
+		rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, results[resource.targetName])
+	}
+
+	if len(copies) > 0 {
+		transferCopies(rn, source, target, copies, dryRunSet)
+	}
+
+	removeTransferredResources(rn, source, dryRunSet)
+}
+
+// importByIdentity imports the resources that have an identity with a single
+// plan and apply, and returns the ones that have to fall back to their identifiers
+func importByIdentity(rn *RunHandler, target Executor, resources []*ImportObject, dryRunSet map[string]*DryRunSet) []*ImportObject {
+	importBlocks := make(map[string]string)
+	for _, resource := range resources {
+		importBlocks[resource.targetName] = RenderIdentityImportBlock(resource.targetName, resource.identity)
+	}
+
+	if dryRunSet != nil {
+		for _, resource := range resources {
+			dryRunSet[resource.topLevelName].AddImportCommand(importBlocks[resource.targetName])
+			rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, nil)
+		}
+		return nil
+	}
+
+	fallbacks := make([]*ImportObject, 0)
+	results := runBatchImport(target, importBlocks)
+	for _, resource := range resources {
+		if results[resource.targetName] != nil {
+			fallbacks = append(fallbacks, resource)
+			continue
+		}
+		rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, nil)
+	}
+	return fallbacks
+}
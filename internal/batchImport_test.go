@@ -0,0 +1,168 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlanDiagnostics(t *testing.T) {
+	output := `{"@level":"info","@message":"Terraform 1.9.0","type":"version","terraform":"1.9.0"}
+{"@level":"warn","type":"diagnostic","diagnostic":{"severity":"warning","summary":"Deprecated"}}
+{"@level":"error","type":"diagnostic","diagnostic":{"severity":"error","summary":"Cannot import non-existent remote object","detail":"The object does not exist.","address":"aws_dynamodb_table.this"}}
+{"@level":"error","type":"diagnostic","diagnostic":{"severity":"error","summary":"Configuration for import target does not exist","range":{"filename":"tfstate_transfer_imports.tf","start":{"line":8,"column":3}}}}
+not json at all`
+
+	diagnostics := internal.ParsePlanDiagnostics(output)
+	assert.Len(t, diagnostics, 2)
+	assert.Equal(t, "aws_dynamodb_table.this", diagnostics[0].Address)
+	assert.Equal(t, 8, diagnostics[1].Range.Start.Line)
+}
+
+func TestParsePlannedChanges(t *testing.T) {
+	output := `{"@level":"info","type":"planned_change","change":{"resource":{"addr":"aws_iam_role.reader"},"action":"import","importing":{"id":"reader"}}}
+{"@level":"info","type":"planned_change","change":{"resource":{"addr":"aws_iam_role.writer"},"action":"update","importing":{"id":"writer"}}}
+{"@level":"info","type":"resource_drift","change":{"resource":{"addr":"aws_iam_policy.this"},"action":"update"}}
+{"@level":"info","type":"change_summary","changes":{"import":1,"change":1}}`
+
+	assert.Equal(t, map[string]string{
+		"aws_iam_role.reader": "import",
+		"aws_iam_role.writer": "update",
+	}, internal.ParsePlannedChanges(output))
+}
+
+func TestRun_Batch(t *testing.T) {
+	allResources := map[string]string{
+		"aws_iam_role.*":         "aws_iam_role.$1",
+		"aws_ssm_parameter.this": "aws_ssm_parameter.this",
+	}
+	newFake := func(t *testing.T) *faketerraform.Fake {
+		fake := faketerraform.New(t)
+		fake.AddObject("aws_iam_role", "reader", nil)
+		fake.AddObject("aws_iam_role", "writer", nil)
+		fake.AddObject("aws_ssm_parameter", "/app/quoted", nil)
+		fake.AddObject("aws_ssm_parameter", "/app/plain", nil)
+		return fake
+	}
+	applies := func(fake *faketerraform.Fake) int {
+		count := 0
+		for _, call := range fake.Calls() {
+			if call.Args[0] == "apply" {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("rejected imports are dropped", func(t *testing.T) {
+		fake := newFake(t)
+		// Traced back through the line of the import block
+		fake.Unsupported("aws_ssm_parameter")
+		// Traced back through the address of the diagnostic
+		fake.Fail(faketerraform.Failure{Command: "plan", Address: "aws_iam_role.writer", Kind: faketerraform.FailNonExistent})
+		sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+
+		runWithFake(fake, sourceDir, targetDir, internal.RunOptions{ResourceMapping: allResources, Strategy: internal.StrategyBatch})
+
+		assert.Equal(t, []string{"aws_iam_role.reader"}, fake.Addresses(targetDir))
+		assert.ElementsMatch(t, []string{"aws_iam_role.writer",
+			`aws_ssm_parameter.this["it's"]`, `aws_ssm_parameter.this["plain"]`}, fake.Addresses(sourceDir))
+		assert.NoFileExists(t, filepath.Join(targetDir, "tfstate_transfer_imports.tf"))
+	})
+
+	t.Run("imports that would change their resource are dropped", func(t *testing.T) {
+		fake := newFake(t)
+		fake.PlanChange("aws_iam_role.writer", "update")
+		sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+
+		runWithFake(fake, sourceDir, targetDir, internal.RunOptions{ResourceMapping: allResources, Strategy: internal.StrategyBatch})
+
+		assert.ElementsMatch(t, []string{"aws_iam_role.reader",
+			`aws_ssm_parameter.this["it's"]`, `aws_ssm_parameter.this["plain"]`}, fake.Addresses(targetDir))
+		assert.Equal(t, []string{"aws_iam_role.writer"}, fake.Addresses(sourceDir))
+	})
+
+	t.Run("other changes fail the batch", func(t *testing.T) {
+		fake := newFake(t)
+		// The target has drifted on a resource it already manages
+		fake.PlanChange("aws_iam_policy.shared", "update")
+		sourceDir := fake.WorkingDir(runSourceState)
+		targetDir := fake.WorkingDir(`{"version": 4, "serial": 1, "lineage": "target", "resources": [
+  {"mode": "managed", "type": "aws_iam_policy", "name": "shared", "instances": [{"attributes": {"id": "shared"}}]}
+]}`)
+
+		runWithFake(fake, sourceDir, targetDir, internal.RunOptions{ResourceMapping: allResources, Strategy: internal.StrategyBatch})
+
+		assert.Equal(t, 0, applies(fake))
+		assert.Equal(t, []string{"aws_iam_policy.shared"}, fake.Addresses(targetDir))
+		assert.Len(t, fake.Addresses(sourceDir), 4)
+	})
+
+	t.Run("a partial apply keeps what was imported", func(t *testing.T) {
+		fake := newFake(t)
+		fake.Fail(faketerraform.Failure{Command: "apply", Address: `aws_ssm_parameter.this["it's"]`, Kind: faketerraform.FailGeneric})
+		sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+
+		runWithFake(fake, sourceDir, targetDir, internal.RunOptions{ResourceMapping: allResources, Strategy: internal.StrategyBatch})
+
+		assert.Equal(t, 1, applies(fake))
+		assert.ElementsMatch(t, []string{"aws_iam_role.reader", "aws_iam_role.writer",
+			`aws_ssm_parameter.this["plain"]`}, fake.Addresses(targetDir))
+		// The parameters only leave the source together
+		assert.ElementsMatch(t, []string{`aws_ssm_parameter.this["it's"]`, `aws_ssm_parameter.this["plain"]`},
+			fake.Addresses(sourceDir))
+	})
+}
+
+func TestRun_ImportByIdentity(t *testing.T) {
+	state := `{"version": 4, "serial": 1, "lineage": "source", "resources": [
+  {"mode": "managed", "type": "aws_iam_role", "name": "reader", "instances": [
+    {"identity": {"account_id": "123456789012", "name": "reader"}, "attributes": {"id": "reader"}}
+  ]},
+  {"mode": "managed", "type": "aws_iam_role", "name": "writer", "instances": [
+    {"identity": {"account_id": "123456789012", "name": "writer"}, "attributes": {"id": "writer"}}
+  ]}
+]}`
+	imports := func(fake *faketerraform.Fake) []string {
+		addresses := make([]string, 0)
+		for _, call := range fake.Calls() {
+			if call.Args[0] == "import" {
+				addresses = append(addresses, call.Args[2])
+			}
+		}
+		return addresses
+	}
+
+	fake := faketerraform.New(t)
+	fake.SetVersion("Terraform v1.12.0")
+	fake.AddIdentifiedObject("aws_iam_role", "reader", map[string]string{"account_id": "123456789012", "name": "reader"})
+	// The writer cannot be found by its identity, and falls back to its identifier
+	fake.AddIdentifiedObject("aws_iam_role", "writer", map[string]string{"account_id": "210987654321", "name": "writer"})
+	sourceDir, targetDir := fake.WorkingDir(state), fake.WorkingDir("")
+
+	runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.*": "module.iam.aws_iam_role.$1"},
+		Strategy:        internal.StrategyImport,
+	})
+
+	assert.ElementsMatch(t, []string{"module.iam.aws_iam_role.reader", "module.iam.aws_iam_role.writer"}, fake.Addresses(targetDir))
+	assert.Empty(t, fake.Addresses(sourceDir))
+	assert.Equal(t, []string{"module.iam.aws_iam_role.writer"}, imports(fake))
+
+	// Older versions only import by identifier
+	fake = faketerraform.New(t)
+	fake.AddIdentifiedObject("aws_iam_role", "reader", map[string]string{"account_id": "123456789012", "name": "reader"})
+	fake.AddIdentifiedObject("aws_iam_role", "writer", map[string]string{"account_id": "123456789012", "name": "writer"})
+	sourceDir, targetDir = fake.WorkingDir(state), fake.WorkingDir("")
+
+	runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.*": "module.iam.aws_iam_role.$1"},
+		Strategy:        internal.StrategyImport,
+	})
+
+	assert.ElementsMatch(t, []string{"module.iam.aws_iam_role.reader", "module.iam.aws_iam_role.writer"}, imports(fake))
+	assert.Empty(t, fake.Addresses(sourceDir))
+}
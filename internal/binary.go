@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const (
+	BinaryTerraform = "terraform"
+	BinaryOpenTofu  = "tofu"
+	// BinaryTerragrunt wraps one of the others
+	BinaryTerragrunt = "terragrunt"
+
+	ProductTerraform = "Terraform"
+	ProductOpenTofu  = "OpenTofu"
+)
+
+// BinaryVersion is the product and version reported by `terraform version` or `tofu version`
+type BinaryVersion struct {
+	Product string
+	Major   int
+	Minor   int
+	Patch   int
+}
+
+var binaryVersionPattern = regexp.MustCompile(`(?m)^(Terraform|OpenTofu) v(\d+)\.(\d+)\.(\d+)`)
+
+func ParseBinaryVersion(output string) (BinaryVersion, error) {
+	match := binaryVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return BinaryVersion{}, fmt.Errorf("no version was found in %q", output)
+	}
+	version := BinaryVersion{Product: match[1]}
+	version.Major, _ = strconv.Atoi(match[2])
+	version.Minor, _ = strconv.Atoi(match[3])
+	version.Patch, _ = strconv.Atoi(match[4])
+	return version, nil
+}
+
+func (v BinaryVersion) String() string {
+	return fmt.Sprintf("%s v%d.%d.%d", v.Product, v.Major, v.Minor, v.Patch)
+}
+
+func (v BinaryVersion) AtLeast(major int, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// Feature is something the tool only uses when the binary is recent enough,
+// the minimum versions are given per product and a nil one is never supported
+type Feature struct {
+	Name      string
+	Terraform *[2]int
+	OpenTofu  *[2]int
+}
+
+var (
+	FeatureMovedBlocks    = Feature{Name: "moved blocks", Terraform: &[2]int{1, 1}, OpenTofu: &[2]int{1, 6}}
+	FeatureImportBlocks   = Feature{Name: "import blocks", Terraform: &[2]int{1, 5}, OpenTofu: &[2]int{1, 6}}
+	FeatureRemovedBlocks  = Feature{Name: "removed blocks", Terraform: &[2]int{1, 7}, OpenTofu: &[2]int{1, 7}}
+	FeatureIdentityImport = Feature{Name: "importing by identity", Terraform: &[2]int{1, 12}}
+)
+
+func (v BinaryVersion) Supports(feature Feature) bool {
+	minimum := feature.Terraform
+	if v.Product == ProductOpenTofu {
+		minimum = feature.OpenTofu
+	}
+	return minimum != nil && v.AtLeast(minimum[0], minimum[1])
+}
+
+// DetectBinary picks the binary pinned by a .opentofu-version or a .terraform-version
+// file in the directory, and otherwise Terraform unless only OpenTofu is installed
+func DetectBinary(dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, ".opentofu-version")); err == nil {
+		return BinaryOpenTofu
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".terraform-version")); err == nil {
+		return BinaryTerraform
+	}
+	if _, err := exec.LookPath(BinaryTerraform); err != nil {
+		if _, err := exec.LookPath(BinaryOpenTofu); err == nil {
+			return BinaryOpenTofu
+		}
+	}
+	return BinaryTerraform
+}
+
+// IsTerragruntDir tells whether the directory is managed by Terragrunt
+func IsTerragruntDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "terragrunt.hcl"))
+	return err == nil
+}
+
+// supportsFeature probes the binary of the executor, assuming an unknown
+// version supports everything so that a failing probe does not block the run
+func supportsFeature(executor Executor, feature Feature) bool {
+	version, err := executor.Version()
+	if err != nil {
+		fmt.Printf("Warning: the version of the binary in %s is unknown, assuming it supports %s: %v\n",
+			executor.Dir(), feature.Name, err)
+		return true
+	}
+	return version.Supports(feature)
+}
+
+func requireFeature(executor Executor, feature Feature) {
+	if !supportsFeature(executor, feature) {
+		version, _ := executor.Version()
+		Panic(fmt.Sprintf("%s in %s does not support %s.", version, executor.Dir(), feature.Name))
+	}
+}
@@ -0,0 +1,57 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBinaryVersion(t *testing.T) {
+	version, err := internal.ParseBinaryVersion("OpenTofu v1.8.3\non linux_amd64\n")
+	assert.Nil(t, err)
+	assert.Equal(t, internal.BinaryVersion{Product: internal.ProductOpenTofu, Major: 1, Minor: 8, Patch: 3}, version)
+	assert.True(t, version.Supports(internal.FeatureRemovedBlocks))
+	assert.False(t, version.Supports(internal.FeatureIdentityImport))
+
+	version, err = internal.ParseBinaryVersion("Terraform v1.6.6\non darwin_arm64\n")
+	assert.Nil(t, err)
+	assert.True(t, version.Supports(internal.FeatureImportBlocks))
+	assert.False(t, version.Supports(internal.FeatureRemovedBlocks))
+
+	_, err = internal.ParseBinaryVersion("command not found")
+	assert.NotNil(t, err)
+}
+
+func TestDetectBinary(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".opentofu-version"), []byte("1.8.3\n"), 0644))
+	assert.Equal(t, internal.BinaryOpenTofu, internal.DetectBinary(dir))
+
+	dir = t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".terraform-version"), []byte("1.9.0\n"), 0644))
+	assert.Equal(t, internal.BinaryTerraform, internal.DetectBinary(dir))
+}
+
+func TestRun_ImportBlocksOnOldBinary(t *testing.T) {
+	fake := faketerraform.New(t)
+	fake.SetVersion("Terraform v1.6.6")
+	sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+
+	runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+		Strategy:        internal.StrategyImportBlocks,
+	})
+
+	// Terraform 1.6 has import blocks but no removed blocks
+	imports, err := os.ReadFile(filepath.Join(targetDir, internal.ImportBlocksFileName))
+	assert.Nil(t, err)
+	assert.Contains(t, string(imports), "import {")
+	removed, err := os.ReadFile(filepath.Join(sourceDir, internal.RemovedBlocksFileName))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(removed), "removed {")
+	assert.Contains(t, string(removed), "state rm aws_iam_role.reader")
+}
@@ -6,34 +6,209 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
 )
 
 type Resource struct {
 	Source string `json:"source"`
 	Target string `json:"target"`
+
+	// Keys translates the count index (or for_each key) of every instance
+	// to the for_each key it gets in the target, such as {"0": "one"}
+	Keys map[string]string `json:"keys,omitempty"`
+	// KeyAttribute derives the target for_each key from an attribute
+	// of the instance, such as "attributes.name", when Keys has no entry
+	KeyAttribute string `json:"keyAttribute,omitempty"`
+	// Children renames addresses inside a top level module, relative to the
+	// module, such as {"aws_dynamodb_table.this": "aws_dynamodb_table.main"}
+	Children map[string]string `json:"children,omitempty"`
+
+	// ImportId is the identifier to import with, tried before any other,
+	// either for every instance or per instance key
+	ImportId *ImportIdOverride `json:"importId,omitempty"`
+	// IdFields replaces the attributes import identifiers are read from
+	IdFields []string `json:"idFields,omitempty"`
+	// SkipRemove keeps the resource in the source state once it is transferred
+	SkipRemove bool `json:"skipRemove,omitempty"`
+	// AllowFailure lets the rest of the resource be removed from the source
+	// when some of its instances fail, keeping only those in the source
+	AllowFailure bool `json:"allowFailure,omitempty"`
+}
+
+// ImportIdOverride is either a single import identifier, or one per instance
+// key such as {"0": "first-id", "blue": "second-id"}
+type ImportIdOverride struct {
+	Id    string
+	ByKey map[string]string
+}
+
+func (o *ImportIdOverride) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &o.Id); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &o.ByKey); err != nil {
+		return fmt.Errorf("importId should be a string or an object of instance keys to identifiers")
+	}
+	return nil
+}
+
+// For returns the identifier of the instance with the given key, if any
+func (o *ImportIdOverride) For(key string) (string, bool) {
+	if o == nil {
+		return "", false
+	}
+	if o.ByKey == nil {
+		return o.Id, o.Id != ""
+	}
+	id, found := o.ByKey[key]
+	return id, found
+}
+
+// RewriteRule rewrites the target address of every transferred resource
+// matching the regular expression, such as "^module\.legacy\.(.*)$ -> module.platform.$1"
+type RewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// UnmarshalJSON accepts both the object form and the "pattern -> replacement" shorthand
+func (r *RewriteRule) UnmarshalJSON(data []byte) error {
+	var shorthand string
+	if err := json.Unmarshal(data, &shorthand); err == nil {
+		pattern, replacement, found := strings.Cut(shorthand, " -> ")
+		if !found {
+			return fmt.Errorf("rewrite rule %s should look like \"pattern -> replacement\"", shorthand)
+		}
+		r.Pattern, r.Replacement = strings.TrimSpace(pattern), strings.TrimSpace(replacement)
+		return nil
+	}
+
+	type rewriteRule RewriteRule
+	return json.Unmarshal(data, (*rewriteRule)(r))
+}
+
+// TypeMapping renames the resource type in the target address, optionally
+// translating the import identifier to the format the new type expects
+type TypeMapping struct {
+	Source   string       `json:"source"`
+	Target   string       `json:"target"`
+	ImportId *RewriteRule `json:"importId,omitempty"`
 }
 
 type ConfigFile struct {
-	SourceDir string     `json:"SourceDir"`
-	TargetDir string     `json:"TargetDir"`
-	Resources []Resource `json:"resources"`
+	SourceDir string        `json:"SourceDir"`
+	TargetDir string        `json:"TargetDir"`
+	Strategy  string        `json:"strategy"`
+	Resources []Resource    `json:"resources"`
+	Rewrites  []RewriteRule `json:"rewrites"`
+	Types     []TypeMapping `json:"types"`
+
+	// The attributes to read import identifiers from, in order,
+	// in general and for specific resource types
+	IdFields       []string            `json:"idFields"`
+	IdFieldsByType map[string][]string `json:"idFieldsByType"`
+	// Go templates building the import identifier of a resource type out
+	// of the attributes of the instance, such as "{{.role}}/{{.policy_arn}}"
+	IdTemplates map[string]string `json:"idTemplates"`
+	// The binary running in both directories, terraform or tofu, unless
+	// overridden per directory, and detected in each directory when not set
+	Binary       string `json:"binary"`
+	SourceBinary string `json:"sourceBinary"`
+	TargetBinary string `json:"targetBinary"`
+	// The workspaces to transfer between, which may be in the same directory,
+	// and whether to create the target workspace when it does not exist
+	SourceWorkspace string `json:"sourceWorkspace"`
+	TargetWorkspace string `json:"targetWorkspace"`
+	CreateWorkspace bool   `json:"createWorkspace"`
+	// Executables computing the import identifiers of a resource type,
+	// see ResolverRequest for what they receive
+	Resolvers map[string]ResolverCommand `json:"resolvers"`
+	// State files to work on instead of the directories, or the output of
+	// terraform show -json, and where to write the rewritten states
+	SourceState string `json:"sourceState"`
+	TargetState string `json:"targetState"`
+	OutDir      string `json:"outDir"`
+}
+
+const (
+	// StrategyImport re-imports every instance into the target through the provider
+	StrategyImport = "import"
+	// StrategyStateSurgery moves the instances between the pulled state documents
+	// and pushes both states back, without touching the provider
+	StrategyStateSurgery = "state-surgery"
+	// StrategyImportBlocks writes import blocks into the target and removed
+	// blocks into the source, to be applied with a regular plan and apply
+	StrategyImportBlocks = "import-blocks"
+	// StrategyBatch imports every resource with a single plan and apply in the target
+	StrategyBatch = "batch"
+	// StrategyMovedBlocks writes moved blocks for renames within a single configuration
+	StrategyMovedBlocks = "moved-blocks"
+)
+
+var Strategies = []string{StrategyImport, StrategyStateSurgery, StrategyImportBlocks, StrategyBatch, StrategyMovedBlocks}
+
+// RunOptions holds everything Run needs to perform a transfer
+type RunOptions struct {
+	SourceDir       string
+	TargetDir       string
+	ResourceMapping map[string]string
+	ResourceOptions map[string]Resource
+	Rewrites        []RewriteRule
+	Types           []TypeMapping
+	IdFields        []string
+	IdFieldsByType  map[string][]string
+	IdTemplates     map[string]string
+	Resolvers       map[string]ResolverCommand
+	DryRun          bool
+	Strategy        string
+	SourceBinary    string
+	TargetBinary    string
+	SourceWorkspace string
+	TargetWorkspace string
+	CreateWorkspace bool
+	SourceState     string
+	TargetState     string
+	OutDir          string
+
+	// The executors running Terraform in the source and target directories,
+	// Terraform itself is run in SourceDir and TargetDir when they are not set
+	SourceExecutor Executor
+	TargetExecutor Executor
 }
 
 var (
-	Resources      []string
-	SourceDir      string
-	TargetDir      string
-	ConfigFileName string
-	DryRun         bool
+	Resources       []string
+	SourceDir       string
+	TargetDir       string
+	ConfigFileName  string
+	DryRun          bool
+	Strategy        string
+	IdFields        []string
+	Binary          string
+	SourceBinary    string
+	TargetBinary    string
+	SourceWorkspace string
+	TargetWorkspace string
+	CreateWorkspace bool
+	SourceState     string
+	TargetState     string
+	OutDir          string
 )
 
-func UnmarshallConfigFileContent(configFileContent string) (string, string, []string, map[string]string) {
+func ParseConfigFileContent(configFileContent string) ConfigFile {
 	var config ConfigFile
 	err := json.Unmarshal([]byte(configFileContent), &config)
 	if err != nil {
 		Panic(fmt.Sprintf("The configuration file %s is not a valid JSON.", configFileContent))
 	}
+	return config
+}
+
+func UnmarshallConfigFileContent(configFileContent string) (string, string, []string, map[string]string) {
+	config := ParseConfigFileContent(configFileContent)
 
 	var resourceList []string
 	resourceMapping := make(map[string]string)
@@ -64,16 +239,24 @@ func PullAliasesOutFromCli(resources []string) ([]string, map[string]string) {
 	resourceMapping := make(map[string]string)
 
 	for _, resource := range resources {
-		if strings.Contains(resource, ":") {
-			splitResource := strings.SplitN(resource, ":", 2)
-			originalResource := splitResource[0]
-			newResource := splitResource[1]
-			resourceMapping[originalResource] = newResource
-			newResourceList = append(newResourceList, originalResource)
-		} else {
-			newResourceList = append(newResourceList, resource)
-			resourceMapping[resource] = resource
+		// Keys of for_each instances may contain colons themselves
+		originalResource, newResource, renamed := address.Cut(resource, ':')
+		if !renamed {
+			newResource = originalResource
+		}
+
+		sourceAddress, err := address.ParsePattern(originalResource)
+		if err != nil {
+			Panic(err.Error())
+		}
+		if !sourceAddress.IsPattern() {
+			if _, err := address.Parse(newResource); err != nil {
+				Panic(err.Error())
+			}
 		}
+
+		resourceMapping[originalResource] = newResource
+		newResourceList = append(newResourceList, originalResource)
 	}
 
 	return newResourceList, resourceMapping
@@ -88,17 +271,107 @@ func checkPath(dir string) string {
 	return path
 }
 
-func ParseArguments() (string, string, map[string]string, bool) {
+func checkFile(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		Panic(fmt.Sprintf("The state file %s does not exist.", path))
+	}
+}
+
+// applyConfigFile takes the settings shared by every command from the configuration file
+func applyConfigFile(config ConfigFile) {
+	if config.SourceDir != "" {
+		SourceDir = config.SourceDir
+	}
+	if config.TargetDir != "" {
+		TargetDir = config.TargetDir
+	}
+	if config.Binary != "" {
+		Binary = config.Binary
+	}
+	if config.SourceBinary != "" {
+		SourceBinary = config.SourceBinary
+	}
+	if config.TargetBinary != "" {
+		TargetBinary = config.TargetBinary
+	}
+	if config.SourceWorkspace != "" {
+		SourceWorkspace = config.SourceWorkspace
+	}
+	if config.TargetWorkspace != "" {
+		TargetWorkspace = config.TargetWorkspace
+	}
+	CreateWorkspace = CreateWorkspace || config.CreateWorkspace
+	if config.SourceState != "" {
+		SourceState = config.SourceState
+	}
+	if config.TargetState != "" {
+		TargetState = config.TargetState
+	}
+	if config.OutDir != "" {
+		OutDir = config.OutDir
+	}
+}
+
+// defaultBinaries runs the binary given for both directories in those left without one
+func defaultBinaries() {
+	if SourceBinary == "" {
+		SourceBinary = Binary
+	}
+	if TargetBinary == "" {
+		TargetBinary = Binary
+	}
+}
+
+func ParseArguments() RunOptions {
 	var resourceMapping map[string]string
+	var rewrites []RewriteRule
+	var types []TypeMapping
+	var idFieldsByType map[string][]string
+	var idTemplates map[string]string
+	resolvers := make(map[string]ResolverCommand)
+	resourceOptions := make(map[string]Resource)
 
 	if ConfigFileName != "" {
 		configFileContent := OpenConfigFile(ConfigFileName)
 		SourceDir, TargetDir, Resources, resourceMapping = UnmarshallConfigFileContent(configFileContent)
+
+		config := ParseConfigFileContent(configFileContent)
+		if config.Strategy != "" {
+			Strategy = config.Strategy
+		}
+		rewrites = config.Rewrites
+		types = config.Types
+		idFieldsByType = config.IdFieldsByType
+		idTemplates = config.IdTemplates
+		// Resolvers are usually kept next to the configuration file
+		for resourceType, command := range config.Resolvers {
+			resolvers[resourceType] = command.RelativeTo(filepath.Dir(ConfigFileName))
+		}
+		applyConfigFile(config)
+		if len(config.IdFields) > 0 {
+			IdFields = config.IdFields
+		}
+		for _, resource := range config.Resources {
+			resourceOptions[resource.Source] = resource
+		}
 	} else {
 		Resources, resourceMapping = PullAliasesOutFromCli(Resources)
 	}
 
-	if SourceDir == "" || TargetDir == "" {
+	offline := SourceState != "" || TargetState != ""
+	if offline {
+		if SourceState == "" {
+			Panic("A source state file must be specified to work on state files.")
+		}
+		checkFile(SourceState)
+		if TargetState != "" {
+			checkFile(TargetState)
+		}
+		if OutDir == "" && !DryRun {
+			Panic("An output directory must be specified with --out-dir to write the rewritten states to.")
+		}
+	} else if SourceDir == "" || TargetDir == "" {
 		Panic("Both a source directory and a target directory must be specified.")
 	}
 
@@ -106,5 +379,42 @@ func ParseArguments() (string, string, map[string]string, bool) {
 		Panic("A list of resources must be specified, either via the configuration file or using --r.")
 	}
 
-	return SourceDir, TargetDir, resourceMapping, DryRun
+	if Strategy == "" {
+		Strategy = StrategyImport
+		if offline {
+			Strategy = StrategyStateSurgery
+		}
+	}
+	if !slices.Contains(Strategies, Strategy) {
+		Panic(fmt.Sprintf("Unknown strategy %s, expected one of: %s.", Strategy, strings.Join(Strategies, ", ")))
+	}
+	if offline && Strategy != StrategyStateSurgery {
+		// Every other strategy needs Terraform to talk to the providers or the backend
+		Panic(fmt.Sprintf("State files can only be worked on with the %s strategy.", StrategyStateSurgery))
+	}
+
+	defaultBinaries()
+
+	return RunOptions{
+		SourceDir:       SourceDir,
+		TargetDir:       TargetDir,
+		ResourceMapping: resourceMapping,
+		ResourceOptions: resourceOptions,
+		Rewrites:        rewrites,
+		Types:           types,
+		IdFields:        IdFields,
+		IdFieldsByType:  idFieldsByType,
+		IdTemplates:     idTemplates,
+		Resolvers:       resolvers,
+		DryRun:          DryRun,
+		Strategy:        Strategy,
+		SourceBinary:    SourceBinary,
+		TargetBinary:    TargetBinary,
+		SourceWorkspace: SourceWorkspace,
+		TargetWorkspace: TargetWorkspace,
+		CreateWorkspace: CreateWorkspace,
+		SourceState:     SourceState,
+		TargetState:     TargetState,
+		OutDir:          OutDir,
+	}
 }
@@ -45,3 +45,59 @@ func TestPullAliasesOutFromCli(t *testing.T) {
 	assert.Len(t, resources, 2)
 	assert.Equal(t, resourceMapping["module.db"], "module.db2")
 }
+
+func TestPullAliasesOutFromCli_ColonInKey(t *testing.T) {
+	resources := []string{
+		`aws_ssm_parameter.this["db:password"]:aws_ssm_parameter.password`,
+	}
+
+	resources, resourceMapping := internal.PullAliasesOutFromCli(resources)
+	assert.Equal(t, []string{`aws_ssm_parameter.this["db:password"]`}, resources)
+	assert.Equal(t, "aws_ssm_parameter.password", resourceMapping[`aws_ssm_parameter.this["db:password"]`])
+}
+
+func TestParseConfigFileContent_Rewrites(t *testing.T) {
+	configFileContent := `
+{
+  "resources": [{"source": "module.legacy", "target": "module.legacy"}],
+  "rewrites": [
+    "^module\\.legacy\\.(.*)$ -> module.platform.$1",
+    {"pattern": "^module\\.platform\\.aws_iam_role\\.(.*)$", "replacement": "module.iam.aws_iam_role.$1"}
+  ]
+}
+`
+	config := internal.ParseConfigFileContent(configFileContent)
+	assert.Len(t, config.Rewrites, 2)
+	assert.Equal(t, `^module\.legacy\.(.*)$`, config.Rewrites[0].Pattern)
+	assert.Equal(t, "module.platform.$1", config.Rewrites[0].Replacement)
+	assert.Equal(t, "module.iam.aws_iam_role.$1", config.Rewrites[1].Replacement)
+}
+
+func TestParseConfigFileContent_ResourceOverrides(t *testing.T) {
+	configFileContent := `
+{
+  "resources": [
+    {"source": "aws_iam_role.reader", "target": "aws_iam_role.reader", "importId": "reader-role", "skipRemove": true},
+    {"source": "aws_ssm_parameter.this", "target": "aws_ssm_parameter.this", "importId": {"0": "/app/first", "1": "/app/second"}},
+    {"source": "module.tables", "target": "module.tables", "idFields": ["name"], "allowFailure": true}
+  ]
+}
+`
+	config := internal.ParseConfigFileContent(configFileContent)
+
+	id, found := config.Resources[0].ImportId.For("")
+	assert.True(t, found)
+	assert.Equal(t, "reader-role", id)
+	assert.True(t, config.Resources[0].SkipRemove)
+
+	id, found = config.Resources[1].ImportId.For("1")
+	assert.True(t, found)
+	assert.Equal(t, "/app/second", id)
+	_, found = config.Resources[1].ImportId.For("2")
+	assert.False(t, found)
+
+	_, found = config.Resources[2].ImportId.For("")
+	assert.False(t, found)
+	assert.Equal(t, []string{"name"}, config.Resources[2].IdFields)
+	assert.True(t, config.Resources[2].AllowFailure)
+}
@@ -0,0 +1,380 @@
+package faketerraform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+)
+
+// The messages Terraform prints for the failures the fake can simulate
+var failureMessages = map[string]string{
+	FailLock:                 "Error: Error acquiring the state lock",
+	FailUnsupported:          "Error: resource %s doesn't support import\n\nThis resource does not support import.",
+	FailAlreadyManaged:       "Error: Resource already managed by Terraform\n\nTerraform is already managing a remote object for %s.",
+	FailAlreadyManagedByTofu: "Error: Resource already managed by OpenTofu\n\nOpenTofu is already managing a remote object for %s.",
+	FailNonExistent:          "Error: Cannot import non-existent remote object\n\nWhile attempting to import an existing object to %s, the provider detected that no object exists with the given id.",
+	FailGeneric:              "Error: the fake terraform was told to fail for %s",
+}
+
+type invocation struct {
+	dir       string
+	workspace string
+	fakeDir   string
+	config    config
+}
+
+func run(fakeDir string, args []string) int {
+	if fakeDir == "." {
+		// Started through the PATH, the symlink still tells where the fake lives
+		if binary, err := findInPath(); err == nil {
+			fakeDir = filepath.Dir(binary)
+		}
+	}
+
+	dir, _ := os.Getwd()
+	inv := invocation{dir: dir, workspace: os.Getenv("TF_WORKSPACE"), fakeDir: fakeDir}
+	if err := inv.load(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	inv.record(args)
+
+	output, err := inv.dispatch(args)
+	fmt.Print(output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func findInPath() (string, error) {
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if _, err := os.Stat(filepath.Join(dir, configFile)); err == nil {
+			return filepath.Join(dir, BinaryName), nil
+		}
+	}
+	return "", errors.New("the fake terraform is not on the PATH")
+}
+
+func (inv *invocation) load() error {
+	content, err := os.ReadFile(filepath.Join(inv.fakeDir, configFile))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, &inv.config)
+}
+
+func (inv *invocation) save() error {
+	content, err := json.MarshalIndent(inv.config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(inv.fakeDir, configFile), content, 0644)
+}
+
+func (inv *invocation) record(args []string) {
+	line, _ := json.Marshal(Call{Dir: inv.dir, Args: args})
+	file, err := os.OpenFile(filepath.Join(inv.fakeDir, callsFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	_, _ = file.Write(append(line, '\n'))
+}
+
+// positional drops the flags from the arguments
+func positional(args []string) []string {
+	values := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			values = append(values, arg)
+		}
+	}
+	return values
+}
+
+func (inv *invocation) dispatch(args []string) (string, error) {
+	values := positional(args)
+	if len(values) == 0 {
+		return "", errors.New("the fake terraform needs a command")
+	}
+
+	command, rest := values[0], values[1:]
+	if command == "state" && len(rest) > 0 {
+		command, rest = "state "+rest[0], rest[1:]
+	}
+
+	target, id := "", ""
+	if len(rest) > 0 {
+		target = rest[0]
+	}
+	if len(rest) > 1 {
+		id = rest[1]
+	}
+	if err := inv.failure(command, target, id); err != nil {
+		return "", err
+	}
+
+	if command == "workspace" {
+		return inv.workspaceCommand(rest)
+	}
+	if inv.workspace != "" && inv.workspace != DefaultWorkspace {
+		if _, err := os.Stat(filepath.Dir(inv.statePath())); err != nil {
+			return "", fmt.Errorf("Currently selected workspace %q does not exist", inv.workspace)
+		}
+	}
+
+	switch command {
+	case "version":
+		return inv.config.Version + "\non linux_amd64\n", nil
+	case "state pull":
+		content, err := os.ReadFile(inv.statePath())
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return string(content), err
+	case "state push":
+		if len(rest) != 1 {
+			return "", errors.New("state push expects a state file")
+		}
+		return "", inv.push(rest[0])
+	case "state list":
+		state, err := readState(inv.statePath())
+		if err != nil {
+			return "", err
+		}
+		addresses, err := stateAddresses(state)
+		if len(addresses) == 0 {
+			return "", err
+		}
+		return strings.Join(addresses, "\n") + "\n", err
+	case "state rm":
+		return inv.remove(rest)
+	case "state mv":
+		if len(rest) != 2 {
+			return "", errors.New("state mv expects a source and a destination")
+		}
+		return inv.move(rest[0], rest[1])
+	case "plan":
+		return inv.plan(args)
+	case "apply":
+		if len(rest) != 1 {
+			return "", errors.New("the fake terraform only applies saved plans")
+		}
+		return inv.apply(rest[0])
+	case "import":
+		if len(rest) != 2 {
+			return "", errors.New("import expects an address and an id")
+		}
+		return inv.importObject(rest[0], rest[1])
+	}
+	return "", fmt.Errorf("the fake terraform does not support %q", strings.Join(args, " "))
+}
+
+func (inv *invocation) statePath() string {
+	return statePath(inv.dir, inv.workspace)
+}
+
+func (inv *invocation) workspaceCommand(args []string) (string, error) {
+	if inv.workspace != "" {
+		return "", errors.New("Error: The selected workspace is currently overridden using the TF_WORKSPACE environment variable.")
+	}
+	if len(args) == 0 {
+		return "", errors.New("workspace expects a subcommand")
+	}
+
+	switch args[0] {
+	case "list":
+		workspaces := []string{"* " + DefaultWorkspace}
+		entries, _ := os.ReadDir(filepath.Join(inv.dir, workspacesDir))
+		for _, entry := range entries {
+			if entry.IsDir() {
+				workspaces = append(workspaces, "  "+entry.Name())
+			}
+		}
+		return strings.Join(workspaces, "\n") + "\n", nil
+	case "new":
+		if len(args) != 2 {
+			return "", errors.New("workspace new expects a name")
+		}
+		if _, err := os.Stat(filepath.Join(inv.dir, workspacesDir, args[1])); err == nil {
+			return "", fmt.Errorf("Workspace %q already exists", args[1])
+		}
+		if err := os.MkdirAll(filepath.Join(inv.dir, workspacesDir, args[1]), 0755); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Created and switched to workspace %q!\n", args[1]), nil
+	}
+	return "", fmt.Errorf("the fake terraform does not support workspace %s", args[0])
+}
+
+// failure finds the first scripted failure matching the command, using it up
+func (inv *invocation) failure(command string, target string, id string) error {
+	for index, failure := range inv.config.Failures {
+		if failure.Command != command || failure.Times == 0 {
+			continue
+		}
+		if (failure.Address != "" && failure.Address != target) || (failure.Id != "" && failure.Id != id) {
+			continue
+		}
+
+		if failure.Times > 0 {
+			inv.config.Failures[index].Times--
+			if err := inv.save(); err != nil {
+				return err
+			}
+		}
+		return failureError(failure.Kind, target)
+	}
+	return nil
+}
+
+func failureError(kind string, target string) error {
+	message, found := failureMessages[kind]
+	if !found {
+		message = failureMessages[FailGeneric]
+	}
+	if strings.Contains(message, "%s") {
+		message = fmt.Sprintf(message, target)
+	}
+	return errors.New(message)
+}
+
+func (inv *invocation) push(stateFile string) error {
+	content, err := os.ReadFile(stateFile)
+	if err != nil {
+		return err
+	}
+	var pushed map[string]interface{}
+	if err := json.Unmarshal(content, &pushed); err != nil {
+		return err
+	}
+
+	current, err := readState(inv.statePath())
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		if current["lineage"] != pushed["lineage"] {
+			return fmt.Errorf("Error: cannot push a state with lineage %v over one with lineage %v", pushed["lineage"], current["lineage"])
+		}
+		if serial(pushed) < serial(current) {
+			return fmt.Errorf("Error: cannot push a state with serial %d over one with serial %d", serial(pushed), serial(current))
+		}
+	}
+	return writeState(inv.statePath(), pushed)
+}
+
+func (inv *invocation) remove(targets []string) (string, error) {
+	state, err := readState(inv.statePath())
+	if err != nil || state == nil {
+		return "", errors.New("Error: No state file was found!")
+	}
+
+	removed := 0
+	for _, target := range targets {
+		targetAddress, err := address.Parse(target)
+		if err != nil {
+			return "", err
+		}
+		count, err := removeInstances(state, targetAddress)
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return "", fmt.Errorf("Error: Invalid target address\n\nNo matching objects found for %s.", target)
+		}
+		removed += count
+	}
+
+	state["serial"] = float64(serial(state) + 1)
+	if err := writeState(inv.statePath(), state); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Successfully removed %d resource instance(s).\n", removed), nil
+}
+
+func (inv *invocation) move(source string, destination string) (string, error) {
+	state, err := readState(inv.statePath())
+	if err != nil || state == nil {
+		return "", errors.New("Error: No state file was found!")
+	}
+	from, err := address.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	to, err := address.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	moves, err := instancesUnder(state, from)
+	if err != nil {
+		return "", err
+	}
+	if len(moves) == 0 {
+		return "", fmt.Errorf("Error: Invalid source address\n\nCannot move %s: does not match anything in the current state.", source)
+	}
+	if _, err := removeInstances(state, from); err != nil {
+		return "", err
+	}
+	for _, moved := range moves {
+		renamed, err := moved.address.Rewrite(from, to)
+		if err != nil {
+			return "", err
+		}
+		addInstance(state, renamed, moved.attributes)
+	}
+
+	state["serial"] = float64(serial(state) + 1)
+	if err := writeState(inv.statePath(), state); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Successfully moved %d object(s).\n", len(moves)), nil
+}
+
+func (inv *invocation) importObject(target string, id string) (string, error) {
+	targetAddress, err := address.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	resourceType := targetAddress.Resource().Type
+	if slices.Contains(inv.config.UnsupportedTypes, resourceType) {
+		return "", failureError(FailUnsupported, target)
+	}
+
+	state, err := inv.readOrNewState()
+	if err != nil {
+		return "", err
+	}
+	addresses, err := stateAddresses(state)
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(addresses, targetAddress.String()) {
+		if strings.HasPrefix(inv.config.Version, "OpenTofu") {
+			return "", failureError(FailAlreadyManagedByTofu, target)
+		}
+		return "", failureError(FailAlreadyManaged, target)
+	}
+
+	for _, object := range inv.config.Objects {
+		if object.Type != resourceType || object.Id != id {
+			continue
+		}
+		addInstance(state, targetAddress, object.Attributes)
+		state["serial"] = float64(serial(state) + 1)
+		if err := writeState(inv.statePath(), state); err != nil {
+			return "", err
+		}
+		return "Import successful!\n", nil
+	}
+	return "", failureError(FailNonExistent, target)
+}
@@ -0,0 +1,252 @@
+// Package faketerraform provides a fake terraform executable for tests. It serves
+// state pull, state push, state list, state rm and import against terraform.tfstate
+// files in the working directories, laid out like the local backend for workspaces
+// selected with TF_WORKSPACE, and can be told to fail in the ways Terraform does.
+// It also plans and applies the import blocks of the working directories, with
+// machine-readable output, planning the changes it is told to along with them.
+//
+// The fake is the test binary itself, run again through a symlink named terraform,
+// so the tests using it must call Main first thing in their TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		faketerraform.Main()
+//		os.Exit(m.Run())
+//	}
+package faketerraform
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	BinaryName = "terraform"
+	StateFile  = "terraform.tfstate"
+
+	DefaultWorkspace = "default"
+	workspacesDir    = "terraform.tfstate.d"
+
+	// DefaultVersion is what the fake reports unless told otherwise
+	DefaultVersion = "Terraform v1.9.0"
+
+	configFile = "fake.json"
+	callsFile  = "calls.log"
+)
+
+// The failures Terraform reports that the tool reacts to
+const (
+	FailLock           = "lock"
+	FailUnsupported    = "unsupported"
+	FailAlreadyManaged = "already-managed"
+	// FailAlreadyManagedByTofu is how OpenTofu words FailAlreadyManaged
+	FailAlreadyManagedByTofu = "already-managed-tofu"
+	FailNonExistent          = "non-existent"
+	FailGeneric              = "generic"
+	defaultFailureTimes      = -1
+)
+
+// Object is a remote object that can be imported
+type Object struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes"`
+	// Identity lets import blocks find the object by identity rather than by its id
+	Identity map[string]string `json:"identity,omitempty"`
+}
+
+// Failure makes the commands matching it fail. Empty fields match anything,
+// and a failure with Times set only happens that many times.
+type Failure struct {
+	// The command, such as "import", "state pull" or "state rm". The imports
+	// of plan and apply fail on their own when Address is set.
+	Command string `json:"command"`
+	Address string `json:"address,omitempty"`
+	Id      string `json:"id,omitempty"`
+	Kind    string `json:"kind"`
+	Times   int    `json:"times,omitempty"`
+}
+
+type config struct {
+	Version          string    `json:"version"`
+	Objects          []Object  `json:"objects"`
+	UnsupportedTypes []string  `json:"unsupportedTypes"`
+	Failures         []Failure `json:"failures"`
+	// The actions plan reports for addresses, besides importing
+	PlannedChanges map[string]string `json:"plannedChanges"`
+}
+
+// Call is an invocation of the fake
+type Call struct {
+	Dir  string   `json:"dir"`
+	Args []string `json:"args"`
+}
+
+// Fake is an installed fake terraform executable and the remote objects it knows about
+type Fake struct {
+	t   testing.TB
+	dir string
+	// Binary is the path of the executable
+	Binary string
+	config config
+}
+
+// New installs a fake terraform executable in a temporary directory
+func New(t testing.TB) *Fake {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	fake := &Fake{t: t, dir: dir, Binary: filepath.Join(dir, BinaryName), config: config{Version: DefaultVersion}}
+	if err := os.Symlink(executable, fake.Binary); err != nil {
+		t.Fatal(err)
+	}
+	fake.save()
+	return fake
+}
+
+func (f *Fake) save() {
+	content, err := json.MarshalIndent(f.config, "", "  ")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(f.dir, configFile), content, 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// WorkingDir creates a working directory holding the given state, which may be empty
+func (f *Fake) WorkingDir(state string) string {
+	dir := f.t.TempDir()
+	if state != "" {
+		if err := os.WriteFile(filepath.Join(dir, StateFile), []byte(state), 0644); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// WorkingDirWorkspace adds a workspace holding the given state, which may be empty,
+// to a working directory
+func (f *Fake) WorkingDirWorkspace(dir string, workspace string, state string) {
+	if err := os.MkdirAll(filepath.Dir(statePath(dir, workspace)), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if state != "" {
+		if err := os.WriteFile(statePath(dir, workspace), []byte(state), 0644); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+// SetVersion changes what the fake reports as its version, such as "OpenTofu v1.8.0"
+func (f *Fake) SetVersion(version string) {
+	f.config.Version = version
+	f.save()
+}
+
+// AddObject makes a remote object available for import
+func (f *Fake) AddObject(resourceType string, id string, attributes map[string]interface{}) {
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	if _, found := attributes["id"]; !found {
+		attributes["id"] = id
+	}
+	f.config.Objects = append(f.config.Objects, Object{Type: resourceType, Id: id, Attributes: attributes})
+	f.save()
+}
+
+// AddIdentifiedObject makes a remote object available for import, by its id or by its identity
+func (f *Fake) AddIdentifiedObject(resourceType string, id string, identity map[string]string) {
+	f.AddObject(resourceType, id, nil)
+	f.config.Objects[len(f.config.Objects)-1].Identity = identity
+	f.save()
+}
+
+// PlanChange makes plan report the action, such as "update" or "delete", for the
+// address when it is in the state. An import of the address is planned with the
+// action instead of "import".
+func (f *Fake) PlanChange(target string, action string) {
+	if f.config.PlannedChanges == nil {
+		f.config.PlannedChanges = make(map[string]string)
+	}
+	f.config.PlannedChanges[target] = action
+	f.save()
+}
+
+// Unsupported makes every import of the resource type fail as Terraform does
+// for resources that do not implement import
+func (f *Fake) Unsupported(resourceType string) {
+	f.config.UnsupportedTypes = append(f.config.UnsupportedTypes, resourceType)
+	f.save()
+}
+
+// Fail makes the matching commands fail
+func (f *Fake) Fail(failure Failure) {
+	if failure.Times == 0 {
+		failure.Times = defaultFailureTimes
+	}
+	f.config.Failures = append(f.config.Failures, failure)
+	f.save()
+}
+
+// State returns the state stored in a working directory
+func (f *Fake) State(dir string) map[string]interface{} {
+	return f.WorkspaceState(dir, DefaultWorkspace)
+}
+
+// WorkspaceState returns the state of a workspace of a working directory
+func (f *Fake) WorkspaceState(dir string, workspace string) map[string]interface{} {
+	state, err := readState(statePath(dir, workspace))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return state
+}
+
+// Addresses lists the instances in the state of a working directory
+func (f *Fake) Addresses(dir string) []string {
+	return f.WorkspaceAddresses(dir, DefaultWorkspace)
+}
+
+// WorkspaceAddresses lists the instances in the state of a workspace of a working directory
+func (f *Fake) WorkspaceAddresses(dir string, workspace string) []string {
+	addresses, err := stateAddresses(f.WorkspaceState(dir, workspace))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return addresses
+}
+
+// Calls lists every invocation of the fake so far, in order
+func (f *Fake) Calls() []Call {
+	content, err := os.ReadFile(filepath.Join(f.dir, callsFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		f.t.Fatal(err)
+	}
+
+	calls := make([]Call, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var call Call
+		if err := json.Unmarshal([]byte(line), &call); err != nil {
+			f.t.Fatal(err)
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// Main runs the fake when the test binary was started as terraform, and returns otherwise
+func Main() {
+	if filepath.Base(os.Args[0]) != BinaryName {
+		return
+	}
+	os.Exit(run(filepath.Dir(os.Args[0]), os.Args[1:]))
+}
@@ -0,0 +1,303 @@
+package faketerraform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+)
+
+// importBlock is an import block read from the configuration of the working directory
+type importBlock struct {
+	file     string
+	line     int
+	to       string
+	id       string
+	identity map[string]string
+}
+
+// plannedImport is what a saved plan holds for an import
+type plannedImport struct {
+	To         string                 `json:"to"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type savedPlan struct {
+	Imports []plannedImport `json:"imports"`
+}
+
+// readImportBlocks finds the import blocks of the .tf files in the directory. Only
+// the layout the tool writes is understood, one attribute per line.
+func readImportBlocks(dir string) ([]importBlock, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	blocks := make([]importBlock, 0)
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var block *importBlock
+		inIdentity := false
+		for index, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			switch {
+			case block == nil:
+				if line == "import {" {
+					block = &importBlock{file: filepath.Base(file), line: index + 1}
+				}
+			case line == "}" && inIdentity:
+				inIdentity = false
+			case line == "}":
+				blocks = append(blocks, *block)
+				block = nil
+			case line == "identity = {":
+				inIdentity, block.identity = true, make(map[string]string)
+			default:
+				name, value, found := strings.Cut(line, "=")
+				if !found {
+					return nil, fmt.Errorf("%s:%d: the fake terraform cannot read %q", file, index+1, line)
+				}
+				name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+				if strings.HasPrefix(value, `"`) {
+					if value, err = address.Unquote(value); err != nil {
+						return nil, err
+					}
+				}
+				switch {
+				case inIdentity:
+					block.identity[name] = value
+				case name == "to":
+					block.to = value
+				case name == "id":
+					block.id = value
+				}
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// findObject finds the remote object an import block points at
+func (inv *invocation) findObject(resourceType string, block importBlock) (Object, bool) {
+	for _, object := range inv.config.Objects {
+		if object.Type != resourceType {
+			continue
+		}
+		if block.identity == nil && object.Id == block.id {
+			return object, true
+		}
+		if block.identity != nil && len(object.Identity) > 0 && identityMatches(object.Identity, block.identity) {
+			return object, true
+		}
+	}
+	return Object{}, false
+}
+
+func identityMatches(identity map[string]string, attributes map[string]string) bool {
+	for key, value := range identity {
+		if attributes[key] != value {
+			return false
+		}
+	}
+	return len(identity) == len(attributes)
+}
+
+// flagValues returns the values of a flag given as -name=value
+func flagValues(args []string, name string) []string {
+	values := make([]string, 0)
+	for _, arg := range args {
+		if value, found := strings.CutPrefix(arg, "-"+name+"="); found {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// jsonMessage renders a line of the machine-readable output of plan and apply
+func jsonMessage(level string, messageType string, fields map[string]interface{}) string {
+	message := map[string]interface{}{"@level": level, "type": messageType}
+	for key, value := range fields {
+		message[key] = value
+	}
+	line, _ := json.Marshal(message)
+	return string(line) + "\n"
+}
+
+// diagnostic renders an error diagnostic for the address, or for a line of a file
+// when the address is empty, splitting the message as Terraform prints it
+func diagnostic(err error, target string, file string, line int) string {
+	summary, detail, _ := strings.Cut(strings.TrimPrefix(err.Error(), "Error: "), "\n\n")
+	fields := map[string]interface{}{"severity": "error", "summary": summary, "detail": detail}
+	if target != "" {
+		fields["address"] = target
+	} else {
+		fields["range"] = map[string]interface{}{"filename": file, "start": map[string]interface{}{"line": line}}
+	}
+	return jsonMessage("error", "diagnostic", map[string]interface{}{"diagnostic": fields})
+}
+
+func plannedChange(target string, action string) string {
+	return jsonMessage("info", "planned_change", map[string]interface{}{
+		"change": map[string]interface{}{"resource": map[string]interface{}{"addr": target}, "action": action},
+	})
+}
+
+// plan plans the import blocks of the targets, along with the scripted planned changes,
+// and saves the imports to the plan file when no import fails
+func (inv *invocation) plan(args []string) (string, error) {
+	planFiles, targets := flagValues(args, "out"), flagValues(args, "target")
+	if len(planFiles) != 1 {
+		return "", errors.New("the fake terraform only plans to a plan file")
+	}
+
+	blocks, err := readImportBlocks(inv.dir)
+	if err != nil {
+		return "", err
+	}
+	state, err := readState(inv.statePath())
+	if err != nil {
+		return "", err
+	}
+	managed, err := stateAddresses(state)
+	if err != nil {
+		return "", err
+	}
+
+	output := strings.Builder{}
+	failed := false
+	plan := savedPlan{Imports: make([]plannedImport, 0)}
+	for _, block := range blocks {
+		if len(targets) > 0 && !slices.Contains(targets, block.to) {
+			continue
+		}
+		targetAddress, err := address.Parse(block.to)
+		if err != nil {
+			return "", err
+		}
+		resourceType := targetAddress.Resource().Type
+
+		if slices.Contains(managed, block.to) {
+			// Import blocks for resources already in the state have nothing left to do
+			output.WriteString(plannedChange(block.to, "noop"))
+			continue
+		}
+		if slices.Contains(inv.config.UnsupportedTypes, resourceType) {
+			// Terraform points at the import block rather than at the resource
+			output.WriteString(diagnostic(failureError(FailUnsupported, block.to), "", block.file, block.line+1))
+			failed = true
+			continue
+		}
+		if err := inv.failure("plan", block.to, block.id); err != nil {
+			output.WriteString(diagnostic(err, block.to, "", 0))
+			failed = true
+			continue
+		}
+		object, found := inv.findObject(resourceType, block)
+		if !found {
+			output.WriteString(diagnostic(failureError(FailNonExistent, block.to), block.to, "", 0))
+			failed = true
+			continue
+		}
+
+		action := "import"
+		if scripted, found := inv.config.PlannedChanges[block.to]; found {
+			action = scripted
+		}
+		output.WriteString(plannedChange(block.to, action))
+		plan.Imports = append(plan.Imports, plannedImport{To: block.to, Attributes: object.Attributes})
+	}
+
+	// The scripted changes of resources in the state stand for drift Terraform plans along with the targets
+	for _, changed := range sortedAddresses(inv.config.PlannedChanges) {
+		if slices.Contains(managed, changed) {
+			output.WriteString(plannedChange(changed, inv.config.PlannedChanges[changed]))
+		}
+	}
+
+	if failed {
+		return output.String(), errors.New("Error: the plan failed")
+	}
+	content, err := json.Marshal(plan)
+	if err != nil {
+		return "", err
+	}
+	return output.String(), os.WriteFile(planFiles[0], content, 0644)
+}
+
+func sortedAddresses(changes map[string]string) []string {
+	addresses := make([]string, 0, len(changes))
+	for changed := range changes {
+		addresses = append(addresses, changed)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// apply applies the imports of a saved plan, going on past the ones told to fail
+// so that a failed apply leaves the others in the state, as Terraform does
+func (inv *invocation) apply(planFile string) (string, error) {
+	content, err := os.ReadFile(planFile)
+	if err != nil {
+		return "", err
+	}
+	var plan savedPlan
+	if err := json.Unmarshal(content, &plan); err != nil {
+		return "", err
+	}
+
+	state, err := inv.readOrNewState()
+	if err != nil {
+		return "", err
+	}
+
+	output := strings.Builder{}
+	failed, imported := false, 0
+	for _, planned := range plan.Imports {
+		if err := inv.failure("apply", planned.To, ""); err != nil {
+			output.WriteString(diagnostic(err, planned.To, "", 0))
+			failed = true
+			continue
+		}
+		targetAddress, err := address.Parse(planned.To)
+		if err != nil {
+			return "", err
+		}
+		addInstance(state, targetAddress, planned.Attributes)
+		output.WriteString(jsonMessage("info", "apply_complete", map[string]interface{}{
+			"hook": map[string]interface{}{"resource": map[string]interface{}{"addr": planned.To}, "action": "import"},
+		}))
+		imported++
+	}
+
+	if imported > 0 {
+		state["serial"] = float64(serial(state) + 1)
+		if err := writeState(inv.statePath(), state); err != nil {
+			return "", err
+		}
+	}
+	if failed {
+		return output.String(), errors.New("Error: the apply failed")
+	}
+	return output.String(), nil
+}
+
+// readOrNewState reads the state of the workspace, starting a new one when there is none
+func (inv *invocation) readOrNewState() (map[string]interface{}, error) {
+	state, err := readState(inv.statePath())
+	if err != nil || state != nil {
+		return state, err
+	}
+	return map[string]interface{}{"version": 4, "serial": float64(0), "lineage": "fake-" + filepath.Base(inv.dir) + "-" + inv.workspace}, nil
+}
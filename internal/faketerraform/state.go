@@ -0,0 +1,185 @@
+package faketerraform
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+)
+
+// statePath is where the local backend keeps the state of a workspace
+func statePath(dir string, workspace string) string {
+	if workspace == "" || workspace == DefaultWorkspace {
+		return filepath.Join(dir, StateFile)
+	}
+	return filepath.Join(dir, workspacesDir, workspace, StateFile)
+}
+
+func readState(path string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && strings.TrimSpace(string(content)) == "") {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state map[string]interface{}
+	return state, json.Unmarshal(content, &state)
+}
+
+func writeState(path string, state map[string]interface{}) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+func serial(state map[string]interface{}) int {
+	value, _ := state["serial"].(float64)
+	return int(value)
+}
+
+func resources(state map[string]interface{}) []interface{} {
+	list, _ := state["resources"].([]interface{})
+	return list
+}
+
+// resourceAddress is the address of a resource in the state, without its instance key
+func resourceAddress(resource map[string]interface{}) (address.Address, error) {
+	modulePath := address.Address{}
+	if module, _ := resource["module"].(string); module != "" {
+		var err error
+		if modulePath, err = address.Parse(module); err != nil {
+			return address.Address{}, err
+		}
+	}
+
+	step := address.Step{Mode: address.ModeManaged}
+	step.Type, _ = resource["type"].(string)
+	step.Name, _ = resource["name"].(string)
+	if mode, _ := resource["mode"].(string); mode != "" {
+		step.Mode = mode
+	}
+	return address.Address{Steps: append(modulePath.Steps, step)}, nil
+}
+
+func instanceAddress(resource address.Address, instance map[string]interface{}) address.Address {
+	steps := append([]address.Step{}, resource.Steps...)
+	switch key := instance["index_key"].(type) {
+	case string:
+		steps[len(steps)-1].Key = address.StringKey(key)
+	case float64:
+		steps[len(steps)-1].Key = address.IntKey(int(key))
+	}
+	return address.Address{Steps: steps}
+}
+
+func stateAddresses(state map[string]interface{}) ([]string, error) {
+	addresses := make([]string, 0)
+	for _, item := range resources(state) {
+		resource, _ := item.(map[string]interface{})
+		base, err := resourceAddress(resource)
+		if err != nil {
+			return nil, err
+		}
+		instances, _ := resource["instances"].([]interface{})
+		for _, instance := range instances {
+			instanceMap, _ := instance.(map[string]interface{})
+			addresses = append(addresses, instanceAddress(base, instanceMap).String())
+		}
+	}
+	return addresses, nil
+}
+
+type stateInstance struct {
+	address    address.Address
+	attributes map[string]interface{}
+}
+
+// instancesUnder lists the instances the address contains
+func instancesUnder(state map[string]interface{}, target address.Address) ([]stateInstance, error) {
+	found := make([]stateInstance, 0)
+	for _, item := range resources(state) {
+		resource, _ := item.(map[string]interface{})
+		base, err := resourceAddress(resource)
+		if err != nil {
+			return nil, err
+		}
+		instances, _ := resource["instances"].([]interface{})
+		for _, instance := range instances {
+			instanceMap, _ := instance.(map[string]interface{})
+			instanceAddress := instanceAddress(base, instanceMap)
+			if target.Contains(instanceAddress) {
+				attributes, _ := instanceMap["attributes"].(map[string]interface{})
+				found = append(found, stateInstance{address: instanceAddress, attributes: attributes})
+			}
+		}
+	}
+	return found, nil
+}
+
+// removeInstances removes every instance the address contains, and the resources left empty
+func removeInstances(state map[string]interface{}, target address.Address) (int, error) {
+	removed := 0
+	kept := make([]interface{}, 0)
+	for _, item := range resources(state) {
+		resource, _ := item.(map[string]interface{})
+		base, err := resourceAddress(resource)
+		if err != nil {
+			return 0, err
+		}
+
+		instances, _ := resource["instances"].([]interface{})
+		keptInstances := make([]interface{}, 0, len(instances))
+		for _, instance := range instances {
+			instanceMap, _ := instance.(map[string]interface{})
+			if target.Contains(instanceAddress(base, instanceMap)) {
+				removed++
+				continue
+			}
+			keptInstances = append(keptInstances, instance)
+		}
+
+		if len(keptInstances) > 0 {
+			resource["instances"] = keptInstances
+			kept = append(kept, resource)
+		}
+	}
+	state["resources"] = kept
+	return removed, nil
+}
+
+func addInstance(state map[string]interface{}, target address.Address, attributes map[string]interface{}) {
+	step := *target.Resource()
+	instance := map[string]interface{}{"schema_version": 0, "attributes": attributes}
+	if step.Key != nil {
+		instance["index_key"] = step.Key.Value()
+	}
+
+	module := target.ModulePath().String()
+	for _, item := range resources(state) {
+		resource, _ := item.(map[string]interface{})
+		resourceModule, _ := resource["module"].(string)
+		if resourceModule == module && resource["type"] == step.Type && resource["name"] == step.Name && resource["mode"] == step.Mode {
+			instances, _ := resource["instances"].([]interface{})
+			resource["instances"] = append(instances, instance)
+			return
+		}
+	}
+
+	provider := strings.SplitN(step.Type, "_", 2)[0]
+	resource := map[string]interface{}{
+		"mode":      step.Mode,
+		"type":      step.Type,
+		"name":      step.Name,
+		"provider":  "provider[\"registry.terraform.io/hashicorp/" + provider + "\"]",
+		"instances": []interface{}{instance},
+	}
+	if module != "" {
+		resource["module"] = module
+	}
+	state["resources"] = append(resources(state), resource)
+}
@@ -5,8 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 
+	"github.com/kassett/tfstate-transfer/internal/address"
 	"github.com/olekukonko/tablewriter"
 )
 
@@ -17,6 +22,129 @@ type ImportObject struct {
 	targetName   string
 	topLevelName string
 	identifier   map[string]*string
+
+	// The order in which the identifier fields are tried
+	identifierFields []string
+
+	// Translates the identifiers when the resource changes type
+	identifierRewrite *compiledRewriteRule
+
+	// Every attribute of the instance, and the templates building
+	// its import identifier out of them, in order
+	attributes      map[string]interface{}
+	importTemplates []*template.Template
+
+	// The identifier given in the configuration file, if any
+	importId string
+
+	// The identifiers computed by a resolver plugin, only once they are needed,
+	// and the templates of the catalog, tried after the templates of the user
+	resolver         *lazyImportIds
+	catalogTemplates []*template.Template
+
+	// The resource cannot be imported and is copied between the states instead
+	copyState bool
+
+	// The resource identity recorded in the state by newer providers, if any
+	identity map[string]interface{}
+}
+
+// ImportIds lists the identifiers to try when importing the resource, in order
+func (i ImportObject) ImportIds() []string {
+	ids := make([]string, 0)
+	i.eachImportId(func(id string) bool {
+		ids = append(ids, id)
+		return false
+	})
+	return ids
+}
+
+// eachImportId calls try with the identifiers in order, without repeating any, until it
+// returns true. The resolver only runs once the identifiers before its own are used up.
+func (i ImportObject) eachImportId(try func(id string) bool) {
+	seen := make(map[string]bool)
+	tryAll := func(ids []string) bool {
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if try(id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if i.importId != "" && tryAll([]string{i.importId}) {
+		return
+	}
+	if tryAll(i.renderTemplates(i.importTemplates)) || tryAll(i.resolver.ids()) {
+		return
+	}
+	if tryAll(i.renderTemplates(i.catalogTemplates)) {
+		return
+	}
+	for _, field := range i.identifierFields {
+		id, exists := i.identifier[field]
+		if !exists || id == nil {
+			continue
+		}
+		value := *id
+		if i.identifierRewrite != nil {
+			value = i.identifierRewrite.apply(*id)
+		}
+		if tryAll([]string{value}) {
+			return
+		}
+	}
+}
+
+// lazyImportIds runs a resolver the first time its identifiers are asked for
+type lazyImportIds struct {
+	resolve  func() []string
+	resolved []string
+	done     bool
+}
+
+func (l *lazyImportIds) ids() []string {
+	if l == nil {
+		return nil
+	}
+	if !l.done {
+		l.resolved, l.done = l.resolve(), true
+	}
+	return l.resolved
+}
+
+func (i ImportObject) renderTemplates(importTemplates []*template.Template) []string {
+	ids := make([]string, 0)
+	for _, importTemplate := range importTemplates {
+		if id, err := renderImportTemplate(importTemplate, i.attributes); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (i ImportObject) SourceName() string {
+	return i.sourceName
+}
+
+func (i ImportObject) TargetName() string {
+	return i.targetName
+}
+
+func (i ImportObject) TopLevelName() string {
+	return i.topLevelName
+}
+
+func (i ImportObject) CopiesState() bool {
+	return i.copyState
+}
+
+func (i ImportObject) Identity() map[string]interface{} {
+	return i.identity
 }
 
 type ImportRunResult struct {
@@ -24,8 +152,10 @@ type ImportRunResult struct {
 	sourceResourceName  string
 	targetResourceName  string
 	success             bool
-	errorReceived       error
-	suggestion          string
+	// The transfer is only written out, and happens once applied
+	pending       bool
+	errorReceived error
+	suggestion    string
 }
 
 type RunHandler struct {
@@ -51,50 +181,369 @@ type RunHandler struct {
 	// The results of the run for output
 	importResults []ImportRunResult
 
+	// The top level resources that stay in the source state, and the ones
+	// whose successful instances are removed even when others fail
+	skipRemove   map[string]bool
+	allowFailure map[string]bool
+
 	// fatal error
 	fatal error
 }
 
-func checkIfResourceBelongsToState(resourceName string, resourceMapping map[string]string) (bool, string, string) {
+type resourceRule struct {
+	sourceName string
+	targetName string
+	source     address.Address
+	target     address.Address
+	options    Resource
+
+	// Renames of addresses inside a top level module, relative to the module
+	children []resourceRule
+}
+
+func parseResourceMapping(resourceMapping map[string]string, resourceOptions map[string]Resource) []resourceRule {
+	rules := make([]resourceRule, 0, len(resourceMapping))
 	for source, target := range resourceMapping {
-		if strings.HasPrefix(resourceName, source) {
-			return true, source, strings.Replace(resourceName, source, target, 1)
+		sourceAddress, err := address.ParsePattern(source)
+		if err != nil {
+			Panic(err.Error())
+		}
+
+		rule := resourceRule{sourceName: source, targetName: target, source: sourceAddress, options: resourceOptions[source]}
+		if len(rule.options.Children) > 0 {
+			rule.children = parseResourceMapping(rule.options.Children, nil)
 		}
+		if !sourceAddress.IsPattern() {
+			// Targets of patterns can only be parsed once the wildcards are known
+			if rule.target, err = address.Parse(target); err != nil {
+				Panic(err.Error())
+			}
+		}
+		rules = append(rules, rule)
 	}
-	return false, "", ""
+
+	// The most specific rule wins when several of them contain the same resource
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].source.Steps) != len(rules[j].source.Steps) {
+			return len(rules[i].source.Steps) > len(rules[j].source.Steps)
+		}
+		if rules[i].source.IsPattern() != rules[j].source.IsPattern() {
+			return !rules[i].source.IsPattern()
+		}
+		return rules[i].sourceName < rules[j].sourceName
+	})
+	return rules
 }
 
-func makeUnique(slice []string) *[]string {
-	keys := make(map[string]bool)
-	var list []string
-	for _, entry := range slice {
-		if _, value := keys[entry]; !value {
-			keys[entry] = true
-			list = append(list, entry)
+// resolve finds the top level resource and its target for a resource matching the rule
+func (r resourceRule) resolve(resourceAddress address.Address) (address.Address, address.Address, bool) {
+	if !r.source.IsPattern() {
+		return r.source, r.target, r.source.Contains(resourceAddress)
+	}
+
+	topLevel, captures, matched := r.source.Match(resourceAddress)
+	if !matched {
+		return address.Address{}, address.Address{}, false
+	}
+	if r.targetName == r.sourceName {
+		return topLevel, topLevel, true
+	}
+	targetName, err := address.Expand(r.targetName, captures)
+	if err != nil {
+		Panic(err.Error())
+	}
+	target, err := address.Parse(targetName)
+	if err != nil {
+		Panic(err.Error())
+	}
+	return topLevel, target, true
+}
+
+type compiledRewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func compileRewriteRule(rewrite RewriteRule) compiledRewriteRule {
+	pattern, err := regexp.Compile(rewrite.Pattern)
+	if err != nil {
+		Panic(fmt.Sprintf("The rewrite rule %s is not a valid regular expression: %v", rewrite.Pattern, err))
+	}
+	return compiledRewriteRule{pattern: pattern, replacement: rewrite.Replacement}
+}
+
+func compileRewriteRules(rewrites []RewriteRule) []compiledRewriteRule {
+	compiled := make([]compiledRewriteRule, 0, len(rewrites))
+	for _, rewrite := range rewrites {
+		compiled = append(compiled, compileRewriteRule(rewrite))
+	}
+	return compiled
+}
+
+func (r compiledRewriteRule) apply(value string) string {
+	if !r.pattern.MatchString(value) {
+		return value
+	}
+	return r.pattern.ReplaceAllString(value, r.replacement)
+}
+
+// applyRewriteRules passes the target name through every matching rule, in order
+func applyRewriteRules(targetName string, rewrites []compiledRewriteRule) string {
+	for _, rewrite := range rewrites {
+		targetName = rewrite.apply(targetName)
+	}
+	if len(rewrites) > 0 {
+		if _, err := address.Parse(targetName); err != nil {
+			Panic(fmt.Sprintf("The rewrite rules produced an invalid address: %v", err))
 		}
 	}
-	return &list
+	return targetName
 }
 
-func NewRunHandler(stateFileContent string, resourceMapping map[string]string) *RunHandler {
-	topLevelResourceMapping := make(map[string][]string)
-	sourceTargetNameMapping := make(map[string]string)
-	resourceIdentifiers := make(map[string]*ImportObject)
-	resourcesToImport := NewStack()
-	completedImports := make(map[string]bool)
-	importResults := make([]ImportRunResult, 0)
+type compiledTypeMapping struct {
+	target   string
+	importId *compiledRewriteRule
+}
 
-	var parsed map[string]interface{}
-	if err := json.Unmarshal([]byte(stateFileContent), &parsed); err != nil {
-		fmt.Println("Error parsing JSON:", err)
+func compileTypeMappings(types []TypeMapping) map[string]compiledTypeMapping {
+	compiled := make(map[string]compiledTypeMapping)
+	for _, typeMapping := range types {
+		mapping := compiledTypeMapping{target: typeMapping.Target}
+		if typeMapping.ImportId != nil {
+			importId := compileRewriteRule(*typeMapping.ImportId)
+			mapping.importId = &importId
+		}
+		compiled[typeMapping.Source] = mapping
+	}
+	return compiled
+}
+
+// applyTypeMapping renames the resource type of the target, returning the
+// translation of the import identifiers that goes with it
+func applyTypeMapping(targetAddress address.Address, types map[string]compiledTypeMapping) (address.Address, *compiledRewriteRule) {
+	resource := targetAddress.Resource()
+	if resource == nil {
+		return targetAddress, nil
+	}
+	mapping, found := types[resource.Type]
+	if !found {
+		return targetAddress, nil
+	}
+
+	steps := append([]address.Step{}, targetAddress.Steps...)
+	steps[len(steps)-1].Type = mapping.target
+	return address.Address{Steps: steps}, mapping.importId
+}
+
+// stateInstance is a single managed resource instance read from the state
+type stateInstance struct {
+	address    address.Address
+	attributes map[string]interface{}
+	identity   map[string]interface{}
+}
+
+// resourceMatch is a state instance selected by one of the resource rules
+type resourceMatch struct {
+	instance stateInstance
+	rule     resourceRule
+	topLevel address.Address
+	target   address.Address
+}
+
+func matchResource(instance stateInstance, rules []resourceRule) (resourceMatch, bool) {
+	for _, rule := range rules {
+		topLevel, target, belongs := rule.resolve(instance.address)
+		if belongs {
+			return resourceMatch{instance: instance, rule: rule, topLevel: topLevel, target: target}, true
+		}
+	}
+	return resourceMatch{}, false
+}
+
+// instanceGroup is the instance of the top level resource this instance belongs to,
+// such as module.table_count[0] for module.table_count[0].aws_dynamodb_table.this
+func (m resourceMatch) instanceGroup() string {
+	return address.Address{Steps: m.instance.address.Steps[:len(m.topLevel.Steps)]}.String()
+}
+
+// instanceKey is the raw key of the instance itself, such as "0" or "blue"
+func (m resourceMatch) instanceKey() string {
+	key := m.instance.address.Resource().Key
+	if key == nil {
+		return ""
+	}
+	return rawKey(key)
+}
+
+func rawKey(key *address.Key) string {
+	if key.IsString {
+		return key.Str
+	}
+	return strconv.Itoa(key.Int)
+}
+
+// checkSingleImportIds refuses a single importId for a resource matching several
+// instances, which would import the same remote object at every address
+func checkSingleImportIds(matches []resourceMatch) {
+	instances := make(map[string]int)
+	for _, match := range matches {
+		if importId := match.rule.options.ImportId; importId != nil && importId.ByKey == nil {
+			instances[match.rule.sourceName]++
+		}
+	}
+	for _, sourceName := range sortedKeys(instances) {
+		if instances[sourceName] > 1 {
+			Panic(fmt.Sprintf("The importId of %s is a single identifier, but it matches %d instances, "+
+				"give one identifier per instance key instead.", sourceName, instances[sourceName]))
+		}
+	}
+}
+
+// carriedKey is the instance key that moves over to the target unchanged, if any
+func (m resourceMatch) carriedKey() *address.Key {
+	last := len(m.topLevel.Steps) - 1
+	if m.topLevel.Steps[last].Key != nil || m.target.Steps[len(m.target.Steps)-1].Key != nil {
 		return nil
 	}
+	return m.instance.address.Steps[last].Key
+}
+
+// keyAttributeValues finds, for every instance group of a resource with a keyAttribute,
+// the first value of that attribute among the instances of the group
+func keyAttributeValues(matches []resourceMatch) map[string]string {
+	values := make(map[string]string)
+	for _, match := range matches {
+		keyAttribute := match.rule.options.KeyAttribute
+		if keyAttribute == "" || match.carriedKey() == nil {
+			continue
+		}
+		if _, found := values[match.instanceGroup()]; found {
+			continue
+		}
+		if value, ok := attributeValue(match.instance.attributes, keyAttribute); ok {
+			values[match.instanceGroup()] = value
+		}
+	}
+	return values
+}
+
+// targetAddress moves the instance to its target, translating count indexes to for_each keys when asked to
+func (m resourceMatch) targetAddress(keyAttributes map[string]string) address.Address {
+	target := m.target
+	key := m.carriedKey()
+	options := m.rule.options
+
+	if key != nil && (options.Keys != nil || options.KeyAttribute != "") {
+		var newKey *address.Key
+		if mapped, ok := options.Keys[rawKey(key)]; ok {
+			newKey = address.StringKey(mapped)
+		} else if value, ok := keyAttributes[m.instanceGroup()]; ok {
+			newKey = address.StringKey(value)
+		} else {
+			Panic(fmt.Sprintf("No target key was found for %s.", m.instanceGroup()))
+		}
+
+		steps := append([]address.Step{}, target.Steps...)
+		steps[len(steps)-1].Key = newKey
+		target = address.Address{Steps: steps}
+	}
+
+	targetAddress, err := m.instance.address.Rewrite(m.topLevel, target)
+	if err != nil {
+		Panic(err.Error())
+	}
+	return renameChild(targetAddress, len(target.Steps), m.rule.children)
+}
+
+// renameChild applies the renames of the top level module to the part
+// of the address inside the module, which starts at the given step
+func renameChild(targetAddress address.Address, start int, children []resourceRule) address.Address {
+	if len(children) == 0 || start >= len(targetAddress.Steps) {
+		return targetAddress
+	}
+
+	relative := address.Address{Steps: targetAddress.Steps[start:]}
+	for _, child := range children {
+		from, to, belongs := child.resolve(relative)
+		if !belongs {
+			continue
+		}
+		renamed, err := relative.Rewrite(from, to)
+		if err != nil {
+			Panic(err.Error())
+		}
+		steps := append(append([]address.Step{}, targetAddress.Steps[:start]...), renamed.Steps...)
+		return address.Address{Steps: steps}
+	}
+	return targetAddress
+}
+
+// attributeValue reads an attribute of an instance as a string. The path may
+// optionally start with "attributes." and walk into nested objects and lists,
+// such as "tags.Name", "subnet_ids.0" or "ingress[0].cidr_blocks[1]"
+func attributeValue(attributes map[string]interface{}, path string) (string, bool) {
+	path = strings.TrimPrefix(path, "attributes.")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+
+	var current interface{} = attributes
+	for _, part := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			current = node[part]
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			current = node[index]
+		default:
+			return "", false
+		}
+	}
+
+	switch value := current.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// identifierFieldsFor lists the attributes to read import identifiers from for a resource type,
+// the fields of the type first and the general fields after them, unless the resource has its own
+func identifierFieldsFor(resourceType string, resource Resource, options RunOptions) []string {
+	if len(resource.IdFields) > 0 {
+		return *makeUnique(resource.IdFields)
+	}
+	fields := append([]string{}, options.IdFieldsByType[resourceType]...)
+	if len(options.IdFields) > 0 {
+		fields = append(fields, options.IdFields...)
+	} else {
+		fields = append(fields, ImportIdentifierFields...)
+	}
+	return *makeUnique(fields)
+}
+
+func readStateInstances(stateFileContent string) ([]stateInstance, error) {
+	// Numbers are kept as written, as float64 would render large ones in exponent notation
+	var parsed map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(stateFileContent))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
 
 	resources, ok := parsed["resources"].([]interface{})
 	if !ok {
-		return nil
+		return nil, errors.New("the state does not contain any resources")
 	}
 
+	stateInstances := make([]stateInstance, 0)
 	for _, res := range resources {
 		resMap, ok := res.(map[string]interface{})
 		if !ok || resMap["mode"] != "managed" {
@@ -117,38 +566,168 @@ func NewRunHandler(stateFileContent string, resourceMapping map[string]string) *
 				continue
 			}
 
-			extractedFields := make(map[string]*string)
-			for _, field := range ImportIdentifierFields {
-				if value, ok := attributes[field].(string); ok {
-					extractedFields[field] = &value
-				}
+			instanceAddress, err := stateInstanceAddress(resMap, instMap)
+			if err != nil {
+				continue
 			}
+			identity, _ := instMap["identity"].(map[string]interface{})
+			stateInstances = append(stateInstances, stateInstance{
+				address:    instanceAddress,
+				attributes: attributes,
+				identity:   identity,
+			})
+		}
+	}
+	return stateInstances, nil
+}
 
-			fullPath := fmt.Sprintf("%s.%s", resMap["type"].(string), resMap["name"].(string))
-			if index, ok := instMap["index_key"]; ok {
-				if stringKey, ok := index.(string); ok {
-					fullPath += fmt.Sprintf("[\"%s\"]", stringKey)
-				} else {
-					fullPath += fmt.Sprintf("[%v]", index)
-				}
-			}
-			if module, ok := resMap["module"].(string); ok {
-				fullPath = module + "." + fullPath
+// stateInstanceAddress builds the address of a resource instance from its entries in the state
+func stateInstanceAddress(resMap map[string]interface{}, instMap map[string]interface{}) (address.Address, error) {
+	modulePath := address.Address{}
+	if module, ok := resMap["module"].(string); ok && module != "" {
+		var err error
+		if modulePath, err = address.Parse(module); err != nil {
+			return address.Address{}, err
+		}
+	}
+
+	resourceType, _ := resMap["type"].(string)
+	resourceName, _ := resMap["name"].(string)
+	step := address.Step{Mode: address.ModeManaged, Type: resourceType, Name: resourceName}
+	if mode, ok := resMap["mode"].(string); ok && mode != "" {
+		step.Mode = mode
+	}
+
+	switch index := instMap["index_key"].(type) {
+	case string:
+		step.Key = address.StringKey(index)
+	case float64:
+		step.Key = address.IntKey(int(index))
+	case json.Number:
+		value, err := index.Int64()
+		if err != nil {
+			return address.Address{}, err
+		}
+		step.Key = address.IntKey(int(value))
+	}
+
+	return address.Address{Steps: append(modulePath.Steps, step)}, nil
+}
+
+func makeUnique(slice []string) *[]string {
+	keys := make(map[string]bool)
+	var list []string
+	for _, entry := range slice {
+		if _, value := keys[entry]; !value {
+			keys[entry] = true
+			list = append(list, entry)
+		}
+	}
+	return &list
+}
+
+func NewRunHandler(stateFileContent string, options RunOptions) (*RunHandler, error) {
+	topLevelResourceMapping := make(map[string][]string)
+	sourceTargetNameMapping := make(map[string]string)
+	resourceIdentifiers := make(map[string]*ImportObject)
+	resourcesToImport := NewStack()
+	completedImports := make(map[string]bool)
+	importResults := make([]ImportRunResult, 0)
+	rules := parseResourceMapping(options.ResourceMapping, options.ResourceOptions)
+	rewrites := compileRewriteRules(options.Rewrites)
+	types := compileTypeMappings(options.Types)
+	importTemplates := compileImportTemplates(options.IdTemplates)
+	targetNames := make(map[string]string)
+	skipRemove := make(map[string]bool)
+	allowFailure := make(map[string]bool)
+
+	if strings.TrimSpace(stateFileContent) == "" {
+		return nil, errors.New("the state is empty")
+	}
+	stateInstances, err := readStateInstances(stateFileContent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check which resources belong to something defined top-level
+	matches := make([]resourceMatch, 0)
+	for _, instance := range stateInstances {
+		if match, belongsToState := matchResource(instance, rules); belongsToState {
+			matches = append(matches, match)
+		}
+	}
+	keyAttributes := keyAttributeValues(matches)
+	checkSingleImportIds(matches)
+
+	for _, match := range matches {
+		identifierFields := identifierFieldsFor(match.instance.address.Resource().Type, match.rule.options, options)
+		extractedFields := make(map[string]*string)
+		for _, field := range identifierFields {
+			if value, ok := attributeValue(match.instance.attributes, field); ok {
+				extractedFields[field] = &value
 			}
+		}
 
-			// Check if the resource belongs to something defined top-level
-			belongsToState, topLevel, newFullPath := checkIfResourceBelongsToState(fullPath, resourceMapping)
-			if belongsToState {
-				sourceTargetNameMapping[fullPath] = newFullPath
-				resourceIdentifiers[fullPath] = &ImportObject{
-					sourceName:   fullPath,
-					targetName:   newFullPath,
-					topLevelName: topLevel,
-					identifier:   extractedFields,
-				}
-				topLevelResourceMapping[topLevel] = append(topLevelResourceMapping[topLevel], fullPath)
+		fullPath := match.instance.address.String()
+		topLevel := match.topLevel.String()
+		targetAddress, identifierRewrite := applyTypeMapping(match.targetAddress(keyAttributes), types)
+		newFullPath := applyRewriteRules(targetAddress.String(), rewrites)
+
+		// Templates describe the identifier of the type being imported into,
+		// the ones of the user come before the resolvers and the catalog
+		resourceTypes := *makeUnique([]string{targetAddress.Resource().Type, match.instance.address.Resource().Type})
+		resourceTemplates := make([]*template.Template, 0)
+		catalogTemplates := make([]*template.Template, 0)
+		for _, resourceType := range resourceTypes {
+			if importTemplate, found := importTemplates[resourceType]; found {
+				resourceTemplates = append(resourceTemplates, importTemplate)
 			}
+			catalogTemplates = append(catalogTemplates, importCatalog.Templates(resourceType)...)
+		}
+		resolverRequest := ResolverRequest{
+			Address:       newFullPath,
+			SourceAddress: fullPath,
+			Attributes:    match.instance.attributes,
+		}
+		resolver := &lazyImportIds{resolve: func() []string {
+			return resolveImportIds(options.Resolvers, resourceTypes, resolverRequest)
+		}}
+
+		importId, _ := match.rule.options.ImportId.For(match.instanceKey())
+		identity := match.instance.identity
+		if targetAddress.Resource().Type != match.instance.address.Resource().Type {
+			// The identity is in the schema of the source type, the target type may not accept it
+			identity = nil
+		}
+		if match.rule.options.SkipRemove {
+			skipRemove[topLevel] = true
+		}
+		if match.rule.options.AllowFailure {
+			allowFailure[topLevel] = true
+		}
+
+		if existing, taken := targetNames[newFullPath]; taken && existing != fullPath {
+			Panic(fmt.Sprintf("Both %s and %s would be transferred to %s.", existing, fullPath, newFullPath))
+		}
+		targetNames[newFullPath] = fullPath
+		sourceTargetNameMapping[fullPath] = newFullPath
+		resourceIdentifiers[fullPath] = &ImportObject{
+			sourceName:   fullPath,
+			targetName:   newFullPath,
+			topLevelName: topLevel,
+			identifier:   extractedFields,
+
+			identifierFields:  identifierFields,
+			identifierRewrite: identifierRewrite,
+			importId:          importId,
+			attributes:        match.instance.attributes,
+			importTemplates:   resourceTemplates,
+			resolver:          resolver,
+			catalogTemplates:  catalogTemplates,
+			copyState:         importCatalog.CopiesState(targetAddress.Resource().Type),
+			identity:          identity,
 		}
+		topLevelResourceMapping[topLevel] = append(topLevelResourceMapping[topLevel], fullPath)
 	}
 
 	for topLevel := range topLevelResourceMapping {
@@ -166,7 +745,9 @@ func NewRunHandler(stateFileContent string, resourceMapping map[string]string) *
 		resourcesToImport:       resourcesToImport,
 		completedImports:        completedImports,
 		importResults:           importResults,
-	}
+		skipRemove:              skipRemove,
+		allowFailure:            allowFailure,
+	}, nil
 }
 
 func (rn *RunHandler) HasNextResource() bool {
@@ -209,24 +790,59 @@ func (rn *RunHandler) ResourcesToDelete() []string {
 	// Check which Resources can be deleted
 	parentsToDelete := make([]string, 0)
 	for parent, children := range rn.topLevelResourceMapping {
+		if rn.skipRemove[parent] {
+			continue
+		}
 
 		allSuccessfulImports := true
+		successfulImports := make([]string, 0)
 
 		for _, child := range children {
 			if !rn.completedImports[child] {
 				allSuccessfulImports = false
-				break
+			} else {
+				successfulImports = append(successfulImports, child)
 			}
 		}
 
 		if allSuccessfulImports {
 			parentsToDelete = append(parentsToDelete, parent)
+		} else if rn.allowFailure[parent] {
+			// Only the instances that made it are removed, the failed ones stay behind
+			parentsToDelete = append(parentsToDelete, successfulImports...)
 		}
 	}
 
 	return parentsToDelete
 }
 
+func (rn *RunHandler) hasIdentities() bool {
+	for _, resource := range rn.resourceIdentifiers {
+		if len(resource.identity) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (rn *RunHandler) dropIdentities() {
+	for _, resource := range rn.resourceIdentifiers {
+		resource.identity = nil
+	}
+}
+
+// DeleteGroup is the top level resource a resource to delete belongs to
+func (rn *RunHandler) DeleteGroup(deleteResource string) string {
+	if _, found := rn.topLevelResourceMapping[deleteResource]; found {
+		return deleteResource
+	}
+	topLevel, err := rn.GetTopLevelFromResource(deleteResource)
+	if err != nil {
+		return deleteResource
+	}
+	return topLevel
+}
+
 func (rn *RunHandler) ReportImportRun(sourceResourceName string,
 	targetResourceName string, userDefinedResource string, errorReceived error) {
 	// After having attempted to perform an import, tell the handler about the output
@@ -243,6 +859,21 @@ func (rn *RunHandler) ReportImportRun(sourceResourceName string,
 	rn.importResults = append(rn.importResults, importRunResult)
 }
 
+// ReportPending records a resource that is set up to be transferred by a later
+// apply, which counts as transferred, but is reported as pending with the note
+func (rn *RunHandler) ReportPending(sourceResourceName string,
+	targetResourceName string, userDefinedResource string, note string) {
+	rn.completedImports[sourceResourceName] = true
+	rn.importResults = append(rn.importResults, ImportRunResult{
+		userDefinedResource: userDefinedResource,
+		sourceResourceName:  sourceResourceName,
+		targetResourceName:  targetResourceName,
+		success:             true,
+		pending:             true,
+		suggestion:          note,
+	})
+}
+
 func Panic(fatalError string) {
 	red := fmt.Sprintf("\033[%dm", tablewriter.FgRedColor)
 	reset := "\033[0m"
@@ -277,15 +908,27 @@ func (rn *RunHandler) PrintFullRun() {
 		{tablewriter.FgGreenColor},
 	}
 
+	yellowRow := []tablewriter.Colors{
+		{tablewriter.FgYellowColor},
+		{tablewriter.FgYellowColor},
+		{tablewriter.FgYellowColor},
+		{tablewriter.FgYellowColor},
+		{tablewriter.FgYellowColor},
+	}
+
 	for _, resultRow := range rn.importResults {
 		success := "True"
-		if !resultRow.success {
+		if resultRow.pending {
+			success = "Pending"
+		} else if !resultRow.success {
 			success = "False"
 		}
 
 		errorString := "N/A"
 		if resultRow.errorReceived != nil {
 			errorString = resultRow.errorReceived.Error()
+		} else if resultRow.pending {
+			errorString = resultRow.suggestion
 		}
 
 		row := []string{
@@ -296,7 +939,9 @@ func (rn *RunHandler) PrintFullRun() {
 			errorString,
 		}
 
-		if resultRow.success {
+		if resultRow.pending {
+			table.Rich(row, yellowRow)
+		} else if resultRow.success {
 			// Print row in green if success is true
 			table.Rich(row, greenRow)
 		} else {
@@ -0,0 +1,465 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+const handlerState = `
+{
+  "version": 4,
+  "resources": [
+    {
+      "module": "module.table_count[0]",
+      "mode": "managed",
+      "type": "aws_dynamodb_table",
+      "name": "this",
+      "instances": [{"attributes": {"id": "case3-1", "name": "case3-1"}}]
+    },
+    {
+      "module": "module.table_count[1]",
+      "mode": "managed",
+      "type": "aws_dynamodb_table",
+      "name": "this",
+      "instances": [{"attributes": {"id": "case3-2", "name": "case3-2"}}]
+    },
+    {
+      "module": "module.table_count_replica",
+      "mode": "managed",
+      "type": "aws_dynamodb_table",
+      "name": "this",
+      "instances": [{"attributes": {"id": "replica"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_iam_role",
+      "name": "reader",
+      "instances": [{"attributes": {"id": "reader"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_iam_role",
+      "name": "writer",
+      "instances": [{"attributes": {"id": "writer"}}]
+    }
+  ]
+}
+`
+
+func newRunHandler(t *testing.T, state string, options internal.RunOptions) *internal.RunHandler {
+	rn, err := internal.NewRunHandler(state, options)
+	assert.NoError(t, err)
+	return rn
+}
+
+// transfers drains the handler and returns its source to target mapping
+func transfers(rn *internal.RunHandler) map[string]string {
+	mapping := make(map[string]string)
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		mapping[resource.SourceName()] = resource.TargetName()
+	}
+	return mapping
+}
+
+func TestNewRunHandler(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"module.table_count": "module.tables",
+		},
+	})
+
+	assert.Equal(t, map[string]string{
+		"module.table_count[0].aws_dynamodb_table.this": "module.tables[0].aws_dynamodb_table.this",
+		"module.table_count[1].aws_dynamodb_table.this": "module.tables[1].aws_dynamodb_table.this",
+	}, transfers(rn))
+}
+
+func TestNewRunHandler_UnreadableState(t *testing.T) {
+	options := internal.RunOptions{ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"}}
+	_, err := internal.NewRunHandler("", options)
+	assert.ErrorContains(t, err, "empty")
+	_, err = internal.NewRunHandler(`{"version": 4}`, options)
+	assert.Error(t, err)
+}
+
+func TestNewRunHandler_Patterns(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"aws_iam_role.*": "module.iam.aws_iam_role.$1",
+		},
+	})
+
+	assert.Equal(t, map[string]string{
+		"aws_iam_role.reader": "module.iam.aws_iam_role.reader",
+		"aws_iam_role.writer": "module.iam.aws_iam_role.writer",
+	}, transfers(rn))
+
+	rn = newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"module.*[*].aws_dynamodb_table.this": "module.$1[$2].aws_dynamodb_table.this",
+		},
+	})
+	top, _ := rn.GetTopLevelFromResource("module.table_count[1].aws_dynamodb_table.this")
+	assert.Equal(t, "module.table_count[1].aws_dynamodb_table.this", top)
+	assert.Len(t, transfers(rn), 2)
+}
+
+func TestNewRunHandler_Rewrites(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"module.table_count":  "module.table_count",
+			"aws_iam_role.reader": "aws_iam_role.reader",
+		},
+		Rewrites: []internal.RewriteRule{
+			{Pattern: `^module\.table_count\[(\d+)\]\.(.*)$`, Replacement: "module.platform.module.tables[$1].$2"},
+			{Pattern: `^(aws_iam_role\..*)$`, Replacement: "module.iam.$1"},
+			{Pattern: `^module\.iam\.`, Replacement: "module.access."},
+		},
+	})
+
+	assert.Equal(t, map[string]string{
+		"module.table_count[0].aws_dynamodb_table.this": "module.platform.module.tables[0].aws_dynamodb_table.this",
+		"module.table_count[1].aws_dynamodb_table.this": "module.platform.module.tables[1].aws_dynamodb_table.this",
+		"aws_iam_role.reader":                           "module.access.aws_iam_role.reader",
+	}, transfers(rn))
+}
+
+func TestNewRunHandler_KeyMapping(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{"module.table_count": "module.tables"},
+		ResourceOptions: map[string]internal.Resource{
+			"module.table_count": {Keys: map[string]string{"0": "one", "1": "two"}},
+		},
+	})
+	assert.Equal(t, map[string]string{
+		"module.table_count[0].aws_dynamodb_table.this": `module.tables["one"].aws_dynamodb_table.this`,
+		"module.table_count[1].aws_dynamodb_table.this": `module.tables["two"].aws_dynamodb_table.this`,
+	}, transfers(rn))
+
+	rn = newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{"module.table_count": "module.tables"},
+		ResourceOptions: map[string]internal.Resource{
+			"module.table_count": {Keys: map[string]string{"0": "first"}, KeyAttribute: "attributes.name"},
+		},
+	})
+	assert.Equal(t, map[string]string{
+		"module.table_count[0].aws_dynamodb_table.this": `module.tables["first"].aws_dynamodb_table.this`,
+		"module.table_count[1].aws_dynamodb_table.this": `module.tables["case3-2"].aws_dynamodb_table.this`,
+	}, transfers(rn))
+}
+
+func TestNewRunHandler_Children(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{"module.table_count[1]": "module.table"},
+		ResourceOptions: map[string]internal.Resource{
+			"module.table_count[1]": {Children: map[string]string{"aws_dynamodb_table.this": "aws_dynamodb_table.main"}},
+		},
+	})
+
+	assert.Equal(t, map[string]string{
+		"module.table_count[1].aws_dynamodb_table.this": "module.table.aws_dynamodb_table.main",
+	}, transfers(rn))
+}
+
+func TestNewRunHandler_Types(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{"module.table_count[0]": "module.table"},
+		Types: []internal.TypeMapping{
+			{
+				Source:   "aws_dynamodb_table",
+				Target:   "aws_dynamodb_global_table",
+				ImportId: &internal.RewriteRule{Pattern: "^(.*)$", Replacement: "global-$1"},
+			},
+		},
+	})
+
+	resource, _ := rn.GetNextResource()
+	assert.Equal(t, "module.table.aws_dynamodb_global_table.this", resource.TargetName())
+	assert.Equal(t, []string{"global-case3-1"}, resource.ImportIds())
+}
+
+func TestNewRunHandler_IdFields(t *testing.T) {
+	state := `
+{
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_lb_listener",
+      "name": "this",
+      "instances": [
+        {
+          "attributes": {
+            "id": "listener-id",
+            "arn": "arn:aws:elasticloadbalancing:listener",
+            "tags": {"Name": "public"},
+            "default_action": [{"target_group_arn": "arn:aws:elasticloadbalancing:targetgroup"}]
+          }
+        }
+      ]
+    }
+  ]
+}
+`
+	rn := newRunHandler(t, state, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_lb_listener.this": "aws_lb_listener.this"},
+		IdFields:        []string{"tags.Name", "missing", "id"},
+		IdFieldsByType: map[string][]string{
+			"aws_lb_listener": {"arn", "default_action[0].target_group_arn"},
+		},
+	})
+
+	resource, _ := rn.GetNextResource()
+	assert.Equal(t, []string{
+		"arn:aws:elasticloadbalancing:listener",
+		"arn:aws:elasticloadbalancing:targetgroup",
+		"public",
+		"listener-id",
+	}, resource.ImportIds())
+}
+
+func TestNewRunHandler_IdTemplates(t *testing.T) {
+	state := `
+{
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_iam_role_policy_attachment",
+      "name": "this",
+      "instances": [
+        {"attributes": {"id": "reader-20240101", "role": "reader", "policy_arn": "arn:aws:iam::aws:policy/ReadOnlyAccess"}}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_iam_user_policy_attachment",
+      "name": "this",
+      "instances": [{"attributes": {"id": "user-20240101"}}]
+    }
+  ]
+}
+`
+	rn := newRunHandler(t, state, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"aws_iam_role_policy_attachment.this": "aws_iam_role_policy_attachment.this",
+			"aws_iam_user_policy_attachment.this": "aws_iam_user_policy_attachment.this",
+		},
+		IdTemplates: map[string]string{
+			"aws_iam_role_policy_attachment": "{{.role}}/{{.policy_arn}}",
+			"aws_iam_user_policy_attachment": "{{.user}}/{{.policy_arn}}",
+		},
+	})
+
+	ids := make(map[string][]string)
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		ids[resource.SourceName()] = resource.ImportIds()
+	}
+
+	assert.Equal(t, []string{"reader/arn:aws:iam::aws:policy/ReadOnlyAccess", "reader-20240101"},
+		ids["aws_iam_role_policy_attachment.this"])
+	// The attributes the template needs are missing, so only the plain fields remain
+	assert.Equal(t, []string{"user-20240101"}, ids["aws_iam_user_policy_attachment.this"])
+}
+
+func TestNewRunHandler_Identity(t *testing.T) {
+	state := `
+{
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_iam_role",
+      "name": "reader",
+      "instances": [
+        {
+          "identity_schema_version": 0,
+          "identity": {"account_id": "123456789012", "name": "reader"},
+          "attributes": {"id": "reader"}
+        }
+      ]
+    }
+  ]
+}
+`
+	rn := newRunHandler(t, state, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+	})
+
+	resource, _ := rn.GetNextResource()
+	assert.Equal(t, "reader", resource.Identity()["name"])
+	assert.Equal(t, []string{"reader"}, resource.ImportIds())
+}
+
+func TestNewRunHandler_IdentityWithTypeMapping(t *testing.T) {
+	state := `{"resources": [{"mode": "managed", "type": "aws_s3_bucket_object", "name": "this", "instances": [
+  {"identity": {"bucket": "assets", "key": "logo.png"}, "attributes": {"id": "logo.png"}}
+]}]}`
+	rn := newRunHandler(t, state, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_s3_bucket_object.this": "aws_s3_bucket_object.this"},
+		Types:           []internal.TypeMapping{{Source: "aws_s3_bucket_object", Target: "aws_s3_object"}},
+	})
+
+	// The identity of the old type is not one of the new type
+	resource, _ := rn.GetNextResource()
+	assert.Empty(t, resource.Identity())
+	assert.Equal(t, []string{"logo.png"}, resource.ImportIds())
+}
+
+func TestNewRunHandler_ResourceOverrides(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"module.table_count":  "module.tables",
+			"aws_iam_role.reader": "aws_iam_role.reader",
+		},
+		ResourceOptions: map[string]internal.Resource{
+			"module.table_count":  {IdFields: []string{"name"}},
+			"aws_iam_role.reader": {ImportId: &internal.ImportIdOverride{Id: "arn:aws:iam::123456789012:role/reader"}},
+		},
+	})
+
+	ids := make(map[string][]string)
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		ids[resource.SourceName()] = resource.ImportIds()
+	}
+
+	assert.Equal(t, []string{"arn:aws:iam::123456789012:role/reader", "reader"}, ids["aws_iam_role.reader"])
+	assert.Equal(t, []string{"case3-1"}, ids["module.table_count[0].aws_dynamodb_table.this"])
+}
+
+func TestRunHandler_ResourcesToDelete(t *testing.T) {
+	options := internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"module.table_count":  "module.tables",
+			"aws_iam_role.reader": "aws_iam_role.reader",
+			"aws_iam_role.writer": "aws_iam_role.writer",
+		},
+		ResourceOptions: map[string]internal.Resource{
+			"module.table_count":  {AllowFailure: true},
+			"aws_iam_role.reader": {SkipRemove: true},
+		},
+	}
+	report := func(rn *internal.RunHandler, failed string) {
+		for rn.HasNextResource() {
+			resource, _ := rn.GetNextResource()
+			var err error
+			if resource.SourceName() == failed {
+				err = errors.New("import failed")
+			}
+			rn.ReportImportRun(resource.SourceName(), resource.TargetName(), resource.TopLevelName(), err)
+		}
+	}
+
+	rn := newRunHandler(t, handlerState, options)
+	report(rn, "")
+	assert.ElementsMatch(t, []string{"module.table_count", "aws_iam_role.writer"}, rn.ResourcesToDelete())
+
+	// The failed instance stays in the source, the rest of its module does not
+	rn = newRunHandler(t, handlerState, options)
+	report(rn, "module.table_count[1].aws_dynamodb_table.this")
+	assert.ElementsMatch(t, []string{"module.table_count[0].aws_dynamodb_table.this", "aws_iam_role.writer"}, rn.ResourcesToDelete())
+	assert.Equal(t, "module.table_count", rn.DeleteGroup("module.table_count[0].aws_dynamodb_table.this"))
+}
+
+func writeResolver(t *testing.T, script string) internal.ResolverCommand {
+	path := filepath.Join(t.TempDir(), "resolver.sh")
+	assert.Nil(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755))
+	return internal.ResolverCommand{path}
+}
+
+func TestNewRunHandler_Resolvers(t *testing.T) {
+	state := `
+{
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "acme_widget",
+      "name": "blue",
+      "instances": [{"attributes": {"id": "w-123", "tenant": "shop"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "acme_gadget",
+      "name": "red",
+      "instances": [{"attributes": {"id": "g-456"}}]
+    }
+  ]
+}
+`
+	// The resolver echoes back what it received, so the request can be checked
+	widgetResolver := writeResolver(t, `input=$(cat)
+case "$input" in
+  *'"type":"acme_widget"'*'"address":"acme_widget.this"'*'"source_address":"acme_widget.blue"'*'"tenant":"shop"'*)
+    echo '["shop/w-123", "w-123"]' ;;
+  *) echo '[]' ;;
+esac
+`)
+	gadgetResolver := writeResolver(t, "echo 'not json'\n")
+
+	rn := newRunHandler(t, state, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"acme_widget.blue": "acme_widget.this",
+			"acme_gadget.red":  "acme_gadget.red",
+		},
+		Resolvers: map[string]internal.ResolverCommand{
+			"acme_widget": widgetResolver,
+			"acme_gadget": gadgetResolver,
+		},
+	})
+
+	ids := make(map[string][]string)
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		ids[resource.SourceName()] = resource.ImportIds()
+	}
+
+	assert.Equal(t, []string{"shop/w-123", "w-123"}, ids["acme_widget.blue"])
+	// A failing resolver leaves the plain fields
+	assert.Equal(t, []string{"g-456"}, ids["acme_gadget.red"])
+}
+
+func TestRunResolver_Failure(t *testing.T) {
+	resolver := writeResolver(t, "echo 'unknown tenant' >&2\nexit 3\n")
+
+	_, err := internal.RunResolver(resolver, internal.ResolverRequest{Type: "acme_widget"})
+	assert.ErrorContains(t, err, "unknown tenant")
+}
+
+func TestNewRunHandler_ResolversRunLazily(t *testing.T) {
+	state := `{"resources": [{"mode": "managed", "type": "acme_widget", "name": "blue", "instances": [{"attributes": {"id": "w-123"}}]}]}`
+	marker := filepath.Join(t.TempDir(), "ran")
+	resolver := writeResolver(t, "touch \"$1\"\necho '[\"resolved\"]'\n")
+
+	rn := newRunHandler(t, state, internal.RunOptions{
+		ResourceMapping: map[string]string{"acme_widget.blue": "acme_widget.blue"},
+		Resolvers:       map[string]internal.ResolverCommand{"acme_widget": append(resolver, marker)},
+	})
+	resource, _ := rn.GetNextResource()
+	// Nothing asked for the identifiers yet
+	assert.NoFileExists(t, marker)
+
+	assert.Equal(t, []string{"resolved", "w-123"}, resource.ImportIds())
+	assert.FileExists(t, marker)
+}
+
+func TestResolverCommand(t *testing.T) {
+	var config internal.ConfigFile
+	assert.Nil(t, json.Unmarshal([]byte(`{"resolvers": {
+  "acme_widget": "./resolvers/widget.sh",
+  "acme_gadget": ["./resolvers/gadget.py", "--tenant", "shop"],
+  "acme_thing": "acme-resolver"
+}}`), &config))
+
+	assert.Equal(t, internal.ResolverCommand{"/etc/tfstate-transfer/resolvers/widget.sh"},
+		config.Resolvers["acme_widget"].RelativeTo("/etc/tfstate-transfer"))
+	assert.Equal(t, internal.ResolverCommand{"/etc/tfstate-transfer/resolvers/gadget.py", "--tenant", "shop"},
+		config.Resolvers["acme_gadget"].RelativeTo("/etc/tfstate-transfer"))
+	// Bare names are looked up in the PATH
+	assert.Equal(t, internal.ResolverCommand{"acme-resolver"}, config.Resolvers["acme_thing"].RelativeTo("/etc/tfstate-transfer"))
+}
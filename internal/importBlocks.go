@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+)
+
+const (
+	ImportBlocksFileName  = "imports.tf"
+	RemovedBlocksFileName = "removed.tf"
+
+	generatedFileHeader = "# Generated by tfstate-transfer\n"
+)
+
+// HclString renders a value as a quoted HCL string, escaping
+// anything HCL would otherwise treat as an escape or a template
+func HclString(value string) string {
+	return address.Quote(value)
+}
+
+func RenderImportBlock(targetName string, id string) string {
+	return fmt.Sprintf("import {\n  to = %s\n  id = %s\n}\n", targetName, HclString(id))
+}
+
+// RenderIdentityImportBlock renders an import block that finds the resource
+// by its identity rather than by an identifier string
+func RenderIdentityImportBlock(targetName string, identity map[string]interface{}) string {
+	keys := make([]string, 0, len(identity))
+	width := 0
+	for key, value := range identity {
+		if value == nil {
+			continue
+		}
+		keys = append(keys, key)
+		width = max(width, len(key))
+	}
+	sort.Strings(keys)
+
+	block := strings.Builder{}
+	block.WriteString(fmt.Sprintf("import {\n  to = %s\n  identity = {\n", targetName))
+	for _, key := range keys {
+		block.WriteString(fmt.Sprintf("    %-*s = %s\n", width, key, hclValue(identity[key])))
+	}
+	block.WriteString("  }\n}\n")
+	return block.String()
+}
+
+func hclValue(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return HclString(typed)
+	case []interface{}:
+		values := make([]string, 0, len(typed))
+		for _, item := range typed {
+			values = append(values, hclValue(item))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case json.Number:
+		return typed.String()
+	case bool:
+		return strconv.FormatBool(typed)
+	case map[string]interface{}:
+		attributes := make([]string, 0, len(typed))
+		for _, key := range sortedKeys(typed) {
+			attributes = append(attributes, fmt.Sprintf("%s = %s", hclKey(key), hclValue(typed[key])))
+		}
+		if len(attributes) == 0 {
+			return "{}"
+		}
+		return "{ " + strings.Join(attributes, ", ") + " }"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprint(typed)
+	}
+}
+
+var hclIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// hclKey renders the key of an object, quoting it unless it is an identifier
+func hclKey(key string) string {
+	if hclIdentifier.MatchString(key) {
+		return key
+	}
+	return HclString(key)
+}
+
+// importBlockFor prefers importing by identity, and falls back to the identifiers
+func importBlockFor(importObject ImportObject) (string, error) {
+	if len(importObject.identity) > 0 {
+		return RenderIdentityImportBlock(importObject.targetName, importObject.identity), nil
+	}
+	id, err := firstImportIdentifier(importObject)
+	if err != nil {
+		return "", err
+	}
+	return RenderImportBlock(importObject.targetName, id), nil
+}
+
+func RenderRemovedBlock(sourceName string) string {
+	return fmt.Sprintf("removed {\n  from = %s\n\n  lifecycle {\n    destroy = false\n  }\n}\n", sourceName)
+}
+
+func firstImportIdentifier(importObject ImportObject) (string, error) {
+	first := ""
+	importObject.eachImportId(func(id string) bool {
+		first = id
+		return true
+	})
+	if first == "" {
+		return "", errors.New("no import identifier was found in the state")
+	}
+	return first, nil
+}
+
+// checkGeneratedFile makes sure that writing the file would not overwrite one the tool did not generate
+func checkGeneratedFile(dir string, fileName string) error {
+	content, err := os.ReadFile(filepath.Join(dir, fileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(content), generatedFileHeader) {
+		return fmt.Errorf("%s already exists and was not generated by tfstate-transfer", filepath.Join(dir, fileName))
+	}
+	return nil
+}
+
+func writeGeneratedFile(dir string, fileName string, blocks []string) error {
+	if err := checkGeneratedFile(dir, fileName); err != nil {
+		return err
+	}
+	content := generatedFileHeader + "\n" + strings.Join(blocks, "\n")
+	return os.WriteFile(filepath.Join(dir, fileName), []byte(content), 0644)
+}
+
+func transferImportBlocks(rn *RunHandler, source Executor, target Executor, dryRunSet map[string]*DryRunSet) {
+	requireFeature(target, FeatureImportBlocks)
+	removedBlocksSupported := supportsFeature(source, FeatureRemovedBlocks)
+	importBlocks := make(map[string]string)
+
+	// Nothing is written unless both files can be
+	for _, err := range []error{checkGeneratedFile(target.Dir(), ImportBlocksFileName), checkGeneratedFile(source.Dir(), RemovedBlocksFileName)} {
+		if err != nil {
+			Panic(fmt.Sprintf("Refusing to write the import and removed blocks: %v.", err))
+		}
+	}
+
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		importBlock, err := importBlockFor(*resource)
+		if resource.copyState {
+			err = errors.New("the resource does not support import, transfer it with --strategy=state-surgery")
+		}
+		if err != nil {
+			rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, err)
+			continue
+		}
+
+		importBlocks[resource.targetName] = importBlock
+		if dryRunSet != nil {
+			dryRunSet[resource.topLevelName].AddImportCommand(importBlocks[resource.targetName])
+		}
+		// The import only happens once the blocks are applied
+		rn.ReportPending(resource.sourceName, resource.targetName, resource.topLevelName,
+			fmt.Sprintf("written to %s, imported once applied", ImportBlocksFileName))
+	}
+
+	removedBlocks := make(map[string]string)
+	for _, deleteResource := range rn.ResourcesToDelete() {
+		removedBlock := RenderRemovedBlock(deleteResource)
+		if deleteAddress, err := address.Parse(deleteResource); err != nil || deleteAddress.HasKeys() || !removedBlocksSupported {
+			// Removed blocks can only point at whole resources and modules, not at instances
+			removedBlock = fmt.Sprintf("# %s cannot be expressed as a removed block, "+
+				"run `%s` once the imports are applied\n", deleteResource, source.CommandLine("state", "rm", deleteResource))
+		}
+		removedBlocks[deleteResource] = removedBlock
+		if dryRunSet != nil {
+			dryRunSet[rn.DeleteGroup(deleteResource)].AddDeleteCommand(removedBlock)
+		}
+	}
+
+	if dryRunSet != nil {
+		return
+	}
+
+	if err := writeGeneratedFile(target.Dir(), ImportBlocksFileName, sortedValues(importBlocks)); err != nil {
+		Panic(fmt.Sprintf("Failed to write %s: %v", filepath.Join(target.Dir(), ImportBlocksFileName), err))
+	}
+	if err := writeGeneratedFile(source.Dir(), RemovedBlocksFileName, sortedValues(removedBlocks)); err != nil {
+		Panic(fmt.Sprintf("Failed to write %s: %v", filepath.Join(source.Dir(), RemovedBlocksFileName), err))
+	}
+}
+
+func sortedKeys[V any](blocks map[string]V) []string {
+	keys := make([]string, 0, len(blocks))
+	for key := range blocks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedValues(blocks map[string]string) []string {
+	keys := sortedKeys(blocks)
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, blocks[key])
+	}
+	return values
+}
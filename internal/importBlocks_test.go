@@ -0,0 +1,69 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHclString(t *testing.T) {
+	assert.Equal(t, `"plain"`, internal.HclString("plain"))
+	assert.Equal(t, `"say \"hi\"\n"`, internal.HclString("say \"hi\"\n"))
+	assert.Equal(t, `"$${var.x} %%{if}"`, internal.HclString("${var.x} %{if}"))
+	assert.Equal(t, `"C:\\temp"`, internal.HclString(`C:\temp`))
+}
+
+func TestRenderImportBlock(t *testing.T) {
+	block := internal.RenderImportBlock(`module.table_foreach["1"].aws_dynamodb_table.this`, "case3-one")
+	assert.Equal(t, "import {\n  to = module.table_foreach[\"1\"].aws_dynamodb_table.this\n  id = \"case3-one\"\n}\n", block)
+}
+
+func TestRenderRemovedBlock(t *testing.T) {
+	block := internal.RenderRemovedBlock("module.table_simple")
+	assert.Contains(t, block, "from = module.table_simple")
+	assert.Contains(t, block, "destroy = false")
+}
+
+func TestRenderIdentityImportBlock(t *testing.T) {
+	block := internal.RenderIdentityImportBlock("aws_iam_role.reader", map[string]interface{}{
+		"name":       "reader",
+		"account_id": "123456789012",
+		"region":     nil,
+		"version":    float64(1000000),
+		"enabled":    true,
+		"tags":       map[string]interface{}{"team": "core", "cost-center": "42", "owner/email": "a@b.c"},
+	})
+	assert.Equal(t, "import {\n"+
+		"  to = aws_iam_role.reader\n"+
+		"  identity = {\n"+
+		"    account_id = \"123456789012\"\n"+
+		"    enabled    = true\n"+
+		"    name       = \"reader\"\n"+
+		"    tags       = { cost-center = \"42\", \"owner/email\" = \"a@b.c\", team = \"core\" }\n"+
+		"    version    = 1000000\n"+
+		"  }\n"+
+		"}\n", block)
+}
+
+func TestRun_ImportBlocksReplacesGeneratedFiles(t *testing.T) {
+	fake := faketerraform.New(t)
+	sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+	previous := "# Generated by tfstate-transfer\n\nimport {\n  to = aws_iam_role.writer\n  id = \"writer\"\n}\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, internal.ImportBlocksFileName), []byte(previous), 0644))
+
+	runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+		Strategy:        internal.StrategyImportBlocks,
+	})
+
+	imports, err := os.ReadFile(filepath.Join(targetDir, internal.ImportBlocksFileName))
+	assert.Nil(t, err)
+	assert.Contains(t, string(imports), "to = aws_iam_role.reader")
+	assert.NotContains(t, string(imports), "aws_iam_role.writer")
+	// Nothing was imported yet
+	assert.Nil(t, fake.State(targetDir))
+}
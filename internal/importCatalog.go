@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"text/template"
+)
+
+// The catalog ships the import identifier formats of common resource types,
+// one file per provider, each versioned on its own
+//
+//go:embed catalog/*.json
+var catalogFiles embed.FS
+
+type importCatalogEntry struct {
+	Templates []string `json:"templates"`
+
+	// Resources that cannot be imported are copied into the target state instead
+	Copy bool `json:"copy"`
+}
+
+type importCatalogFile struct {
+	Version   string                        `json:"version"`
+	Provider  string                        `json:"provider"`
+	Resources map[string]importCatalogEntry `json:"resources"`
+}
+
+type ImportCatalog struct {
+	// The version of the catalog of every provider
+	Versions map[string]string
+
+	templates map[string][]*template.Template
+	copy      map[string]bool
+}
+
+var importCatalog = LoadImportCatalog()
+
+func LoadImportCatalog() *ImportCatalog {
+	catalog := &ImportCatalog{
+		Versions:  make(map[string]string),
+		templates: make(map[string][]*template.Template),
+		copy:      make(map[string]bool),
+	}
+
+	fileNames, _ := catalogFiles.ReadDir("catalog")
+	for _, fileName := range fileNames {
+		content, err := catalogFiles.ReadFile(path.Join("catalog", fileName.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		var file importCatalogFile
+		if err := json.Unmarshal(content, &file); err != nil {
+			panic(fmt.Sprintf("the import catalog %s is not valid: %v", fileName.Name(), err))
+		}
+
+		catalog.Versions[file.Provider] = file.Version
+		for resourceType, entry := range file.Resources {
+			catalog.copy[resourceType] = entry.Copy
+			for _, text := range entry.Templates {
+				catalog.templates[resourceType] = append(catalog.templates[resourceType],
+					template.Must(newImportTemplate(resourceType).Parse(text)))
+			}
+		}
+	}
+	return catalog
+}
+
+// Templates returns the known import identifier formats of a resource type, in order
+func (c *ImportCatalog) Templates(resourceType string) []*template.Template {
+	return c.templates[resourceType]
+}
+
+// CopiesState tells if instances of a resource type have to be copied between
+// the states because the provider does not let them be imported
+func (c *ImportCatalog) CopiesState(resourceType string) bool {
+	return c.copy[resourceType]
+}
@@ -0,0 +1,160 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+const catalogState = `
+{
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_security_group_rule",
+      "name": "https",
+      "instances": [
+        {
+          "attributes": {
+            "id": "sgrule-123",
+            "security_group_id": "sg-6e616f6d69",
+            "type": "ingress",
+            "protocol": "tcp",
+            "from_port": 443,
+            "to_port": 443,
+            "self": false,
+            "source_security_group_id": null,
+            "cidr_blocks": ["10.0.3.0/24", "10.0.4.0/24"],
+            "ipv6_cidr_blocks": [],
+            "prefix_list_ids": []
+          }
+        }
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_route53_record",
+      "name": "www",
+      "instances": [
+        {"attributes": {"id": "Z123_www.example.com_A", "zone_id": "Z123", "name": "www.example.com", "type": "A", "set_identifier": "eu"}}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_route_table_association",
+      "name": "gateway",
+      "instances": [
+        {"attributes": {"id": "rtbassoc-1", "subnet_id": "", "gateway_id": "igw-1", "route_table_id": "rtb-1"}}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_route_table_association",
+      "name": "private",
+      "instances": [
+        {"attributes": {"id": "rtbassoc-2", "subnet_id": "subnet-1", "gateway_id": "", "route_table_id": "rtb-2"}}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_ecs_service",
+      "name": "api",
+      "instances": [
+        {"attributes": {"id": "arn:aws:ecs:us-east-1:123:service/main/api", "cluster": "arn:aws:ecs:us-east-1:123:cluster/main", "name": "api"}}
+      ]
+    }
+  ]
+}
+`
+
+func TestImportCatalog(t *testing.T) {
+	assert.NotEmpty(t, internal.LoadImportCatalog().Versions["registry.terraform.io/hashicorp/aws"])
+
+	rn := newRunHandler(t, catalogState, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"aws_security_group_rule.https":       "aws_security_group_rule.https",
+			"aws_route53_record.www":              "aws_route53_record.www",
+			"aws_route_table_association.gateway": "aws_route_table_association.gateway",
+			"aws_route_table_association.private": "aws_route_table_association.private",
+			"aws_ecs_service.api":                 "aws_ecs_service.api",
+		},
+	})
+
+	ids := make(map[string][]string)
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		ids[resource.SourceName()] = resource.ImportIds()
+	}
+
+	assert.Equal(t, []string{"sg-6e616f6d69_ingress_tcp_443_443_10.0.3.0/24_10.0.4.0/24", "sgrule-123"},
+		ids["aws_security_group_rule.https"])
+	assert.Equal(t, "Z123_www.example.com_A_eu", ids["aws_route53_record.www"][0])
+	// The attribute left empty by Terraform does not make an identifier
+	assert.Equal(t, []string{"igw-1/rtb-1", "rtbassoc-1"}, ids["aws_route_table_association.gateway"])
+	assert.Equal(t, []string{"subnet-1/rtb-2", "rtbassoc-2"}, ids["aws_route_table_association.private"])
+	assert.Equal(t, "main/api", ids["aws_ecs_service.api"][0])
+}
+
+func TestImportCatalog_UtilityProviders(t *testing.T) {
+	state := `
+{
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "random_integer",
+      "name": "port",
+      "instances": [{"attributes": {"id": "8080", "result": 8080, "min": 1024, "max": 65535, "seed": null}}]
+    },
+    {
+      "mode": "managed",
+      "type": "random_integer",
+      "name": "account",
+      "instances": [{"attributes": {"id": "123456789", "result": 123456789, "min": 1000000, "max": 999999999, "seed": null}}]
+    },
+    {
+      "mode": "managed",
+      "type": "random_id",
+      "name": "suffix",
+      "instances": [{"attributes": {"id": "p-9hUg", "b64_url": "p-9hUg", "prefix": "app-"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "random_password",
+      "name": "admin",
+      "instances": [{"attributes": {"id": "none", "result": "hunter2"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "null_resource",
+      "name": "this",
+      "instances": [{"attributes": {"id": "4920233402917431201", "triggers": null}}]
+    }
+  ]
+}
+`
+	rn := newRunHandler(t, state, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"random_integer.port":    "random_integer.port",
+			"random_integer.account": "random_integer.account",
+			"random_id.suffix":       "random_id.suffix",
+			"null_resource.this":     "null_resource.this",
+			"random_password.admin":  "random_password.admin",
+		},
+	})
+
+	resources := make(map[string]*internal.ImportObject)
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		resources[resource.SourceName()] = resource
+	}
+
+	assert.Equal(t, "8080,1024,65535", resources["random_integer.port"].ImportIds()[0])
+	// Large numbers are not rendered in exponent notation
+	assert.Equal(t, "123456789,1000000,999999999", resources["random_integer.account"].ImportIds()[0])
+	assert.Equal(t, "app-,p-9hUg", resources["random_id.suffix"].ImportIds()[0])
+	assert.False(t, resources["random_id.suffix"].CopiesState())
+	assert.True(t, resources["null_resource.this"].CopiesState())
+	// The identifier of a password is the password itself, which is never rendered
+	assert.True(t, resources["random_password.admin"].CopiesState())
+}
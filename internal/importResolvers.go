@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ResolverTimeout bounds how long a resolver may take to answer for a single instance
+var ResolverTimeout = 30 * time.Second
+
+// ResolverCommand is the executable of a resolver followed by its arguments. In the
+// configuration file, it is either a path or an array of the path and the arguments
+type ResolverCommand []string
+
+func (c *ResolverCommand) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*c = ResolverCommand{path}
+		return nil
+	}
+	var command []string
+	if err := json.Unmarshal(data, &command); err != nil || len(command) == 0 || command[0] == "" {
+		return fmt.Errorf("a resolver should be a path or a non-empty array of a path and its arguments")
+	}
+	*c = command
+	return nil
+}
+
+// RelativeTo anchors a relative path of the executable to the directory, the
+// configuration file one, while a bare name is still looked up in the PATH
+func (c ResolverCommand) RelativeTo(dir string) ResolverCommand {
+	if len(c) == 0 || filepath.IsAbs(c[0]) || !strings.ContainsRune(c[0], filepath.Separator) {
+		return c
+	}
+	return append(ResolverCommand{filepath.Join(dir, c[0])}, c[1:]...)
+}
+
+func (c ResolverCommand) String() string {
+	return shellJoin(c)
+}
+
+// ResolverRequest is what a resolver receives on its standard input
+type ResolverRequest struct {
+	Type          string                 `json:"type"`
+	Address       string                 `json:"address"`
+	SourceAddress string                 `json:"source_address"`
+	Attributes    map[string]interface{} `json:"attributes"`
+}
+
+// RunResolver executes a resolver plugin and returns the candidate import
+// identifiers it prints on its standard output as a JSON array, in order
+func RunResolver(command ResolverCommand, request ResolverRequest) ([]string, error) {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ResolverTimeout)
+	defer cancel()
+
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("the resolver %s timed out after %s", command, ResolverTimeout)
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("the resolver %s failed: %v: %s", command, err, message)
+		}
+		return nil, fmt.Errorf("the resolver %s failed: %v", command, err)
+	}
+
+	var ids []string
+	if err := json.Unmarshal(stdout.Bytes(), &ids); err != nil {
+		return nil, fmt.Errorf("the resolver %s did not print a JSON array of strings: %v", command, err)
+	}
+
+	candidates := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			candidates = append(candidates, id)
+		}
+	}
+	return candidates, nil
+}
+
+// resolveImportIds asks the resolver of the first resource type that has one,
+// a failing resolver is reported and leaves the other identifiers to be tried
+func resolveImportIds(resolvers map[string]ResolverCommand, resourceTypes []string, request ResolverRequest) []string {
+	for _, resourceType := range resourceTypes {
+		command, found := resolvers[resourceType]
+		if !found {
+			continue
+		}
+
+		request.Type = resourceType
+		ids, err := RunResolver(command, request)
+		if err != nil {
+			fmt.Printf("Warning: no identifier resolved for %s: %v\n", request.SourceAddress, err)
+			return nil
+		}
+		return ids
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+var importTemplateFunctions = template.FuncMap{
+	"split": strings.Split,
+	"join":  strings.Join,
+	"last": func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[len(values)-1]
+	},
+}
+
+func newImportTemplate(resourceType string) *template.Template {
+	return template.New(resourceType).Option("missingkey=error").Funcs(importTemplateFunctions)
+}
+
+// compileImportTemplates parses the import identifier templates of every resource type
+func compileImportTemplates(idTemplates map[string]string) map[string]*template.Template {
+	compiled := make(map[string]*template.Template)
+	for resourceType, text := range idTemplates {
+		parsed, err := newImportTemplate(resourceType).Parse(text)
+		if err != nil {
+			Panic(fmt.Sprintf("The import identifier template of %s is not valid: %v", resourceType, err))
+		}
+		compiled[resourceType] = parsed
+	}
+	return compiled
+}
+
+// renderImportTemplate evaluates a template against the attributes of an instance,
+// failing when the template refers to anything the instance does not have
+func renderImportTemplate(importTemplate *template.Template, attributes map[string]interface{}) (string, error) {
+	rendered := strings.Builder{}
+	if err := importTemplate.Execute(&rendered, attributes); err != nil {
+		return "", err
+	}
+
+	id := rendered.String()
+	if id == "" || strings.Contains(id, "<no value>") {
+		return "", fmt.Errorf("the template %s did not produce an identifier", importTemplate.Name())
+	}
+	return id, nil
+}
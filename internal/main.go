@@ -1,59 +1,86 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"github.com/olekukonko/tablewriter"
 	"os"
+	"path/filepath"
 )
 
 type DryRunSet struct {
-	deleteCommand  *string
+	deleteCommands []string
 	importCommands []string
 }
 
 func NewDryRunSet() *DryRunSet {
 	return &DryRunSet{
-		deleteCommand:  nil,
+		deleteCommands: make([]string, 0),
 		importCommands: make([]string, 0),
 	}
 }
 
-func (d *DryRunSet) SetDeleteCommand(command string) {
-	d.deleteCommand = &command
+func (d *DryRunSet) AddDeleteCommand(command string) {
+	d.deleteCommands = append(d.deleteCommands, command)
 }
 
 func (d *DryRunSet) AddImportCommand(command string) {
 	d.importCommands = append(d.importCommands, command)
 }
 
-func transferState(rn *RunHandler, sourceDir string, targetDir string, dryRunSet map[string]*DryRunSet) {
+// dryRunEntry returns the commands of a top level resource, creating them when missing
+func dryRunEntry(dryRunSet map[string]*DryRunSet, topLevelName string) *DryRunSet {
+	if _, exists := dryRunSet[topLevelName]; !exists {
+		dryRunSet[topLevelName] = NewDryRunSet()
+	}
+	return dryRunSet[topLevelName]
+}
+
+func transferState(rn *RunHandler, source Executor, target Executor, dryRunSet map[string]*DryRunSet) {
+	copies := make([]*ImportObject, 0)
+	identities := make([]*ImportObject, 0)
+	imports := make([]*ImportObject, 0)
 
 	for rn.HasNextResource() {
 		resource, _ := rn.GetNextResource()
-		command, err := runImport(targetDir, *resource, dryRunSet != nil)
+		switch {
+		case resource.copyState:
+			copies = append(copies, resource)
+		case len(resource.identity) > 0:
+			identities = append(identities, resource)
+		default:
+			imports = append(imports, resource)
+		}
+	}
+
+	// Resources with an identity are imported by it first, and by their identifiers if that fails
+	if len(identities) > 0 {
+		imports = append(imports, importByIdentity(rn, target, identities, dryRunSet)...)
+	}
+
+	for _, resource := range imports {
+		command, err := runImport(target, *resource, dryRunSet != nil)
 
 		rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, err)
 
 		if dryRunSet != nil {
-			// Check if the key exists in the map; if not, create a new DryRunSet entry
-			if _, exists := dryRunSet[resource.topLevelName]; !exists {
-				fmt.Print(1)
-			}
-			// Add the import command to the DryRunSet
-			dryRunSet[resource.topLevelName].AddImportCommand(command)
+			dryRunEntry(dryRunSet, resource.topLevelName).AddImportCommand(command)
 		}
 	}
 
+	if len(copies) > 0 {
+		transferCopies(rn, source, target, copies, dryRunSet)
+	}
+
+	removeTransferredResources(rn, source, dryRunSet)
+}
+
+func removeTransferredResources(rn *RunHandler, source Executor, dryRunSet map[string]*DryRunSet) {
 	resourcesToDelete := rn.ResourcesToDelete()
 	for _, deleteResource := range resourcesToDelete {
-		command := terraformRemoveState(deleteResource, sourceDir, dryRunSet != nil)
+		command := terraformRemoveState(deleteResource, source, dryRunSet != nil)
 		if dryRunSet != nil {
-			// Ensure the key exists before setting the delete command
-			if _, exists := dryRunSet[deleteResource]; !exists {
-				fmt.Println(1)
-			}
-			// Set the delete command
-			dryRunSet[deleteResource].SetDeleteCommand(command)
+			dryRunEntry(dryRunSet, rn.DeleteGroup(deleteResource)).AddDeleteCommand(command)
 		}
 	}
 }
@@ -81,32 +108,133 @@ func PrintDryRun(dryRunSet map[string]*DryRunSet) {
 			)
 		}
 
-		table.Rich(
-			[]string{*dryRun.deleteCommand},
-			[]tablewriter.Colors{
-				{tablewriter.FgRedColor},
-			},
-		)
+		for _, command := range dryRun.deleteCommands {
+			table.Rich(
+				[]string{command},
+				[]tablewriter.Colors{
+					{tablewriter.FgRedColor},
+				},
+			)
+		}
 
 		table.Render()
 	}
 }
 
-func Run(sourceDir string, targetDir string, resourceMapping map[string]string, dryRun bool) {
-	sourceDir = checkPath(sourceDir)
-	targetDir = checkPath(targetDir)
+// pendingWorkspace stands in for a target workspace that a dry run leaves to be
+// created, which has no state until then and cannot be pulled in the meantime
+type pendingWorkspace struct {
+	Executor
+}
+
+func (p pendingWorkspace) StatePull() (string, error)   { return "", nil }
+func (p pendingWorkspace) StateList() ([]string, error) { return nil, nil }
+
+// ensureWorkspaces checks that the workspaces exist, creating the target one when asked to,
+// and returns the target to run against. A dry run leaves a missing target workspace to be
+// created by the real run, and runs against a pending workspace meanwhile.
+func ensureWorkspaces(source Executor, target Executor, create bool, dryRun bool) Executor {
+	if err := source.EnsureWorkspace(false); err != nil {
+		Panic(err.Error())
+	}
+	if err := target.EnsureWorkspace(create && !dryRun); err != nil {
+		var missing *MissingWorkspaceError
+		if !dryRun || !create || !errors.As(err, &missing) {
+			Panic(err.Error())
+		}
+		return pendingWorkspace{target}
+	}
+	return target
+}
+
+func newDirectoryExecutor(binary string, dir string, workspace string) Executor {
+	executor := NewTerraformExecutor(binary, checkPath(dir))
+	executor.WorkspaceName = workspace
+	return executor
+}
 
-	stateFileContent := generateStateFile(sourceDir)
-	runHandler := NewRunHandler(stateFileContent, resourceMapping)
+func Run(options RunOptions) {
+	source, target := options.SourceExecutor, options.TargetExecutor
+	if options.SourceState != "" {
+		offlineSource, offlineTarget := NewOfflineExecutors(options.SourceState, options.TargetState, options.OutDir)
+		if !options.DryRun {
+			if err := os.MkdirAll(options.OutDir, 0755); err != nil {
+				Panic(fmt.Sprintf("The output directory %s could not be created: %v", options.OutDir, err))
+			}
+			// push checks the live states against the ones the staged states are derived from
+			if err := WriteStagedOrigins(options.OutDir, offlineSource, offlineTarget); err != nil {
+				Panic(fmt.Sprintf("Failed to write %s: %v", filepath.Join(options.OutDir, StagedOriginsFileName), err))
+			}
+		}
+		source, target = offlineSource, offlineTarget
+	}
+	if source == nil {
+		source = newDirectoryExecutor(options.SourceBinary, options.SourceDir, options.SourceWorkspace)
+	}
+	if target == nil {
+		target = newDirectoryExecutor(options.TargetBinary, options.TargetDir, options.TargetWorkspace)
+	}
 
-	dryRunSet := map[string]*DryRunSet{}
-	for topLevel, _ := range runHandler.topLevelResourceMapping {
-		dryRunSet[topLevel] = NewDryRunSet()
+	target = ensureWorkspaces(source, target, options.CreateWorkspace, options.DryRun)
+
+	stateFileContent := generateStateFile(source)
+	runHandler, err := NewRunHandler(stateFileContent, options)
+	if err != nil {
+		Panic(fmt.Sprintf("The source state of %s could not be read: %v.", source.Dir(), err))
 	}
 
-	transferState(runHandler, sourceDir, targetDir, dryRunSet)
+	sameState, err := SameState(source, stateFileContent, target, generateStateFile(target))
+	if err != nil {
+		Panic(fmt.Sprintf("Refusing to transfer: %v.", err))
+	}
+	if !sameState && source.Dir() == target.Dir() && options.Strategy == StrategyImportBlocks {
+		// The blocks would apply to every workspace of the directory
+		Panic("Import and removed blocks cannot be written for workspaces of the same directory, use another strategy.")
+	}
+
+	if options.SourceState != "" && sameState {
+		Panic("The source and target state files hold the same state, there is nothing to transfer between them.")
+	}
+
+	if options.Strategy != StrategyStateSurgery && runHandler.hasIdentities() && !supportsFeature(target, FeatureIdentityImport) {
+		// Older binaries can only import by identifier
+		runHandler.dropIdentities()
+	}
+
+	var dryRunSet map[string]*DryRunSet
+	if options.DryRun {
+		dryRunSet = map[string]*DryRunSet{}
+		for topLevel := range runHandler.topLevelResourceMapping {
+			dryRunSet[topLevel] = NewDryRunSet()
+		}
+	}
+
+	if sameState && (options.Strategy == StrategyImportBlocks || options.Strategy == StrategyBatch) {
+		// Renames within one state go through terraform state mv instead
+		Panic(fmt.Sprintf("The source and the target are the same state, the %s strategy cannot import into it, "+
+			"use the %s, %s or %s strategy.", options.Strategy, StrategyImport, StrategyStateSurgery, StrategyMovedBlocks))
+	}
+	if options.Strategy == StrategyMovedBlocks && !sameState {
+		Panic("Moved blocks can only rename resources within a single state, the source and the target must be the same.")
+	}
+
+	switch {
+	case options.Strategy == StrategyMovedBlocks:
+		transferMovedBlocks(runHandler, target, dryRunSet)
+	case sameState:
+		// Nothing needs to be imported, the resources only change their addresses
+		transferSameState(runHandler, source, dryRunSet)
+	case options.Strategy == StrategyStateSurgery:
+		transferStateSurgery(runHandler, source, target, stateFileContent, dryRunSet)
+	case options.Strategy == StrategyImportBlocks:
+		transferImportBlocks(runHandler, source, target, dryRunSet)
+	case options.Strategy == StrategyBatch:
+		transferBatchImport(runHandler, source, target, dryRunSet)
+	default:
+		transferState(runHandler, source, target, dryRunSet)
+	}
 
-	if !dryRun {
+	if !options.DryRun {
 		runHandler.PrintFullRun()
 	} else {
 		PrintDryRun(dryRunSet)
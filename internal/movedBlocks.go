@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+)
+
+const MovedBlocksFileName = "moved.tf"
+
+func RenderMovedBlock(from string, to string) string {
+	return fmt.Sprintf("moved {\n  from = %s\n  to   = %s\n}\n", from, to)
+}
+
+// collapsedMove finds the single move of the top level resource that moves every
+// one of its instances where they are going, if there is one
+func collapsedMove(topLevelName string, moves map[string]string) (address.Address, bool) {
+	topLevel, err := address.Parse(topLevelName)
+	if err != nil || len(moves) == 0 {
+		return address.Address{}, false
+	}
+
+	// Any instance tells where the top level resource would go,
+	// by dropping what is below the top level from its target
+	sourceName := sortedKeys(moves)[0]
+	sourceAddress, err := address.Parse(sourceName)
+	if err != nil {
+		return address.Address{}, false
+	}
+	targetAddress, err := address.Parse(moves[sourceName])
+	below := len(sourceAddress.Steps) - len(topLevel.Steps)
+	if err != nil || len(targetAddress.Steps) <= below {
+		return address.Address{}, false
+	}
+	steps := append([]address.Step{}, targetAddress.Steps[:len(targetAddress.Steps)-below]...)
+	if topLevel.Steps[len(topLevel.Steps)-1].Key == nil {
+		// The instance keys are carried over by the move
+		steps[len(steps)-1].Key = nil
+	}
+	candidate := address.Address{Steps: steps}
+
+	for sourceName, targetName := range moves {
+		sourceAddress, err := address.Parse(sourceName)
+		if err != nil {
+			return address.Address{}, false
+		}
+		moved, err := sourceAddress.Rewrite(topLevel, candidate)
+		if err != nil || moved.String() != targetName {
+			return address.Address{}, false
+		}
+	}
+	return candidate, true
+}
+
+// MovedBlocks turns the moves of every top level resource into moved blocks, a single
+// one for the whole top level resource when all of its instances move together
+func (rn *RunHandler) MovedBlocks() map[string][]string {
+	blocks := make(map[string][]string)
+	for topLevel, sourceNames := range rn.topLevelResourceMapping {
+		moves := make(map[string]string)
+		for _, sourceName := range sourceNames {
+			if targetName := rn.sourceTargetNameMapping[sourceName]; targetName != sourceName {
+				moves[sourceName] = targetName
+			}
+		}
+		if len(moves) == 0 {
+			continue
+		}
+
+		if len(moves) == len(sourceNames) {
+			if target, collapsed := collapsedMove(topLevel, moves); collapsed {
+				blocks[topLevel] = []string{RenderMovedBlock(topLevel, target.String())}
+				continue
+			}
+		}
+		for _, sourceName := range sortedKeys(moves) {
+			blocks[topLevel] = append(blocks[topLevel], RenderMovedBlock(sourceName, moves[sourceName]))
+		}
+	}
+	return blocks
+}
+
+func transferMovedBlocks(rn *RunHandler, executor Executor, dryRunSet map[string]*DryRunSet) {
+	requireFeature(executor, FeatureMovedBlocks)
+	blocks := rn.MovedBlocks()
+	topLevels := make([]string, 0, len(blocks))
+	for topLevel := range blocks {
+		topLevels = append(topLevels, topLevel)
+	}
+	sort.Strings(topLevels)
+
+	movedBlocks := make([]string, 0)
+	for _, topLevel := range topLevels {
+		for _, block := range blocks[topLevel] {
+			movedBlocks = append(movedBlocks, block)
+			if dryRunSet != nil {
+				dryRunSet[topLevel].AddImportCommand(block)
+			}
+		}
+	}
+
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		// Nothing moves until the blocks are applied
+		rn.ReportPending(resource.sourceName, resource.targetName, resource.topLevelName,
+			fmt.Sprintf("written to %s, moved once applied", MovedBlocksFileName))
+	}
+
+	if dryRunSet != nil || len(movedBlocks) == 0 {
+		return
+	}
+	if err := writeGeneratedFile(executor.Dir(), MovedBlocksFileName, movedBlocks); err != nil {
+		Panic(fmt.Sprintf("Failed to write %s: %v", filepath.Join(executor.Dir(), MovedBlocksFileName), err))
+	}
+}
@@ -0,0 +1,63 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMovedBlock(t *testing.T) {
+	assert.Equal(t, "moved {\n  from = module.a\n  to   = module.b\n}\n", internal.RenderMovedBlock("module.a", "module.b"))
+}
+
+func TestRunHandler_MovedBlocks(t *testing.T) {
+	rn := newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"module.table_count":  "module.tables",
+			"aws_iam_role.reader": "aws_iam_role.reader",
+		},
+	})
+	// Every instance of the module moves along with it
+	assert.Equal(t, map[string][]string{
+		"module.table_count": {internal.RenderMovedBlock("module.table_count", "module.tables")},
+	}, rn.MovedBlocks())
+
+	rn = newRunHandler(t, handlerState, internal.RunOptions{
+		ResourceMapping: map[string]string{"module.table_count": "module.tables"},
+		ResourceOptions: map[string]internal.Resource{
+			"module.table_count": {Keys: map[string]string{"0": "one", "1": "two"}},
+		},
+	})
+	// The keys change, so each instance needs its own block
+	assert.Equal(t, map[string][]string{
+		"module.table_count": {
+			internal.RenderMovedBlock("module.table_count[0].aws_dynamodb_table.this", `module.tables["one"].aws_dynamodb_table.this`),
+			internal.RenderMovedBlock("module.table_count[1].aws_dynamodb_table.this", `module.tables["two"].aws_dynamodb_table.this`),
+		},
+	}, rn.MovedBlocks())
+}
+
+func TestRun_MovedBlocks(t *testing.T) {
+	fake := faketerraform.New(t)
+	dir := fake.WorkingDir(runSourceState)
+
+	output := captureOutput(t, func() {
+		runWithFake(fake, dir, dir, internal.RunOptions{
+			ResourceMapping: map[string]string{"aws_ssm_parameter.this": "module.app.aws_ssm_parameter.this"},
+			Strategy:        internal.StrategyMovedBlocks,
+		})
+	})
+
+	moved, err := os.ReadFile(filepath.Join(dir, internal.MovedBlocksFileName))
+	assert.Nil(t, err)
+	assert.Contains(t, string(moved), internal.RenderMovedBlock("aws_ssm_parameter.this", "module.app.aws_ssm_parameter.this"))
+	// The state is left to the next apply
+	assert.Contains(t, fake.Addresses(dir), `aws_ssm_parameter.this["plain"]`)
+	assert.Contains(t, output, "Pending")
+	assert.Contains(t, output, "written to moved.tf, moved once applied")
+	assert.NotContains(t, output, "True")
+}
@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+)
+
+const (
+	SourceStateFileName = "source.tfstate"
+	TargetStateFileName = "target.tfstate"
+	// StagedOriginsFileName records, next to the staged states, the states they are derived from
+	StagedOriginsFileName = "origins.json"
+)
+
+var errOffline = errors.New("not available when working on state files")
+
+// StateFileExecutor stands in for Terraform when working offline: the state is
+// read from a local file, and pushing it writes it to another file for review
+type StateFileExecutor struct {
+	// StateFile holds the state to read, either a state file or the output
+	// of terraform show -json, no file meaning an empty state
+	StateFile string
+	// OutFile is where the pushed state is written
+	OutFile string
+
+	// The output of terraform show -json is only converted once, keeping its new lineage
+	converted *string
+}
+
+func (e *StateFileExecutor) Dir() string {
+	if e.StateFile != "" {
+		return e.StateFile
+	}
+	return e.OutFile
+}
+
+func (e *StateFileExecutor) CommandLine(args ...string) string {
+	if len(args) == 3 && args[0] == "state" && args[1] == "push" {
+		return shellJoin([]string{"cp", args[2], e.OutFile})
+	}
+	return shellJoin(append([]string{BinaryTerraform}, args...))
+}
+
+func (e *StateFileExecutor) StatePull() (string, error) {
+	if e.StateFile == "" {
+		return "", nil
+	}
+	if e.converted != nil {
+		return *e.converted, nil
+	}
+	content, err := os.ReadFile(e.StateFile)
+	if err != nil {
+		return "", err
+	}
+	if IsShowJson(string(content)) {
+		fmt.Printf("Warning: %s is the output of terraform show -json, which has no lineage and leaves out "+
+			"dependencies, private data and sensitive markings, so the states derived from it are for review only "+
+			"and cannot be pushed.\n", e.StateFile)
+		converted, err := ConvertShowJson(string(content))
+		if err != nil {
+			return "", err
+		}
+		e.converted = &converted
+		return converted, nil
+	}
+	return string(content), nil
+}
+
+func (e *StateFileExecutor) StatePush(stateFile string) error {
+	content, err := os.ReadFile(stateFile)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(e.OutFile, content, 0644)
+}
+
+func (e *StateFileExecutor) StateList() ([]string, error) {
+	content, err := e.StatePull()
+	if err != nil || strings.TrimSpace(content) == "" {
+		return nil, err
+	}
+	instances, err := readStateInstances(content)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		addresses = append(addresses, instance.address.String())
+	}
+	return addresses, nil
+}
+
+func (e *StateFileExecutor) StateRm(string) error         { return errOffline }
+func (e *StateFileExecutor) StateMv(string, string) error { return errOffline }
+func (e *StateFileExecutor) Import(string, string) (string, error) {
+	return "", errOffline
+}
+func (e *StateFileExecutor) Plan(string, []string) (string, error) { return "", errOffline }
+func (e *StateFileExecutor) Apply(string) (string, error)          { return "", errOffline }
+func (e *StateFileExecutor) Version() (BinaryVersion, error)       { return BinaryVersion{}, errOffline }
+func (e *StateFileExecutor) Workspace() string                     { return "" }
+func (e *StateFileExecutor) EnsureWorkspace(bool) error            { return nil }
+
+// StagedOrigin is the state a staged state is derived from
+type StagedOrigin struct {
+	// Exists is false when there was no state, the staged one being a new state
+	Exists  bool   `json:"exists"`
+	Lineage string `json:"lineage,omitempty"`
+	Serial  int64  `json:"serial"`
+	// ReviewOnly marks a state read from terraform show -json, which cannot be pushed
+	ReviewOnly bool `json:"reviewOnly,omitempty"`
+}
+
+type StagedOrigins struct {
+	Source StagedOrigin `json:"source"`
+	Target StagedOrigin `json:"target"`
+}
+
+// Origin describes the state the executor reads, as it is in the file
+func (e *StateFileExecutor) Origin() (StagedOrigin, error) {
+	if e.StateFile == "" {
+		return StagedOrigin{}, nil
+	}
+	content, err := os.ReadFile(e.StateFile)
+	if err != nil {
+		return StagedOrigin{}, err
+	}
+	if IsShowJson(string(content)) {
+		return StagedOrigin{Exists: true, ReviewOnly: true}, nil
+	}
+	document, err := ParseStateDocument(string(content))
+	if err != nil || document == nil {
+		return StagedOrigin{}, err
+	}
+	return StagedOrigin{Exists: true, Lineage: document.Lineage(), Serial: document.Serial()}, nil
+}
+
+func WriteStagedOrigins(outDir string, source *StateFileExecutor, target *StateFileExecutor) error {
+	var origins StagedOrigins
+	var err error
+	if origins.Source, err = source.Origin(); err != nil {
+		return err
+	}
+	if origins.Target, err = target.Origin(); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(origins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outDir, StagedOriginsFileName), content, 0644)
+}
+
+func ReadStagedOrigins(outDir string) (StagedOrigins, error) {
+	var origins StagedOrigins
+	content, err := os.ReadFile(filepath.Join(outDir, StagedOriginsFileName))
+	if err != nil {
+		return origins, err
+	}
+	return origins, json.Unmarshal(content, &origins)
+}
+
+// NewOfflineExecutors reads the states from local files, and writes the
+// rewritten states into the output directory
+func NewOfflineExecutors(sourceState string, targetState string, outDir string) (*StateFileExecutor, *StateFileExecutor) {
+	return &StateFileExecutor{StateFile: sourceState, OutFile: filepath.Join(outDir, SourceStateFileName)},
+		&StateFileExecutor{StateFile: targetState, OutFile: filepath.Join(outDir, TargetStateFileName)}
+}
+
+type showJsonResource struct {
+	Address       string                 `json:"address"`
+	Mode          string                 `json:"mode"`
+	Type          string                 `json:"type"`
+	Name          string                 `json:"name"`
+	ProviderName  string                 `json:"provider_name"`
+	SchemaVersion int                    `json:"schema_version"`
+	Values        map[string]interface{} `json:"values"`
+}
+
+type showJsonModule struct {
+	Resources    []showJsonResource `json:"resources"`
+	ChildModules []showJsonModule   `json:"child_modules"`
+}
+
+type showJson struct {
+	FormatVersion    string `json:"format_version"`
+	TerraformVersion string `json:"terraform_version"`
+	Values           *struct {
+		RootModule showJsonModule `json:"root_module"`
+	} `json:"values"`
+}
+
+// providerAddress rebuilds the provider address of the state, older versions
+// of Terraform printing only the name of the provider in show -json
+func providerAddress(providerName string) string {
+	switch strings.Count(providerName, "/") {
+	case 0:
+		providerName = "registry.terraform.io/hashicorp/" + providerName
+	case 1:
+		providerName = "registry.terraform.io/" + providerName
+	}
+	return fmt.Sprintf("provider[%q]", providerName)
+}
+
+// IsShowJson tells the output of terraform show -json apart from a state file
+func IsShowJson(content string) bool {
+	var document map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &document); err != nil {
+		return false
+	}
+	_, hasFormat := document["format_version"]
+	_, hasLineage := document["lineage"]
+	return hasFormat && !hasLineage
+}
+
+// ConvertShowJson turns the output of terraform show -json into a state file. The output
+// carries no lineage, so the state gets a fresh one, and neither dependencies, private data,
+// sensitive markings, identities nor provider aliases, so the state is only good for review
+func ConvertShowJson(content string) (string, error) {
+	var show showJson
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&show); err != nil {
+		return "", err
+	}
+	if show.Values == nil {
+		return "", nil
+	}
+
+	resources := make(map[string]map[string]interface{})
+	var collect func(module showJsonModule) error
+	collect = func(module showJsonModule) error {
+		for _, resource := range module.Resources {
+			resourceAddress, err := address.Parse(resource.Address)
+			if err != nil {
+				return err
+			}
+
+			instance := map[string]interface{}{
+				"schema_version": resource.SchemaVersion,
+				"attributes":     resource.Values,
+			}
+			if key := resourceAddress.Resource().Key; key != nil {
+				instance["index_key"] = key.Value()
+			}
+
+			resourceAddress.Resource().Key = nil
+			name := resourceAddress.String()
+			if _, found := resources[name]; !found {
+				resources[name] = map[string]interface{}{
+					"mode":      resource.Mode,
+					"type":      resource.Type,
+					"name":      resource.Name,
+					"provider":  providerAddress(resource.ProviderName),
+					"instances": []interface{}{},
+				}
+				if module := resourceAddress.ModulePath().String(); module != "" {
+					resources[name]["module"] = module
+				}
+			}
+			resources[name]["instances"] = append(resources[name]["instances"].([]interface{}), instance)
+		}
+		for _, child := range module.ChildModules {
+			if err := collect(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(show.Values.RootModule); err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stateResources := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		stateResources = append(stateResources, resources[name])
+	}
+
+	state, err := json.MarshalIndent(map[string]interface{}{
+		"version":           4,
+		"terraform_version": show.TerraformVersion,
+		"serial":            0,
+		"lineage":           newLineage(),
+		"outputs":           map[string]interface{}{},
+		"resources":         stateResources,
+	}, "", "  ")
+	return strings.TrimSpace(string(state)) + "\n", err
+}
@@ -0,0 +1,126 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+const showJsonOutput = `
+{
+  "format_version": "1.0",
+  "terraform_version": "1.9.0",
+  "values": {
+    "root_module": {
+      "resources": [
+        {
+          "address": "aws_iam_role.reader",
+          "mode": "managed",
+          "type": "aws_iam_role",
+          "name": "reader",
+          "provider_name": "aws",
+          "schema_version": 0,
+          "values": {"id": "reader", "max_session_duration": 43200000}
+        }
+      ],
+      "child_modules": [
+        {
+          "address": "module.app",
+          "resources": [
+            {
+              "address": "module.app.aws_ssm_parameter.this[\"plain\"]",
+              "mode": "managed",
+              "type": "aws_ssm_parameter",
+              "name": "this",
+              "index": "plain",
+              "provider_name": "registry.terraform.io/hashicorp/aws",
+              "schema_version": 0,
+              "values": {"id": "/app/plain"}
+            }
+          ]
+        }
+      ]
+    }
+  }
+}
+`
+
+func readStateFile(t *testing.T, path string) map[string]interface{} {
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var state map[string]interface{}
+	assert.NoError(t, json.Unmarshal(content, &state))
+	return state
+}
+
+func TestConvertShowJson(t *testing.T) {
+	assert.True(t, internal.IsShowJson(showJsonOutput))
+	assert.False(t, internal.IsShowJson(runSourceState))
+
+	content, err := internal.ConvertShowJson(showJsonOutput)
+	assert.NoError(t, err)
+
+	executor := &internal.StateFileExecutor{StateFile: filepath.Join(t.TempDir(), "show.json")}
+	assert.NoError(t, os.WriteFile(executor.StateFile, []byte(content), 0644))
+	addresses, err := executor.StateList()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"aws_iam_role.reader", `module.app.aws_ssm_parameter.this["plain"]`}, addresses)
+
+	state := readStateFile(t, executor.StateFile)
+	resource := state["resources"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, `provider["registry.terraform.io/hashicorp/aws"]`, resource["provider"])
+	assert.Contains(t, content, `"max_session_duration": 43200000`)
+}
+
+func TestRun_StateFiles(t *testing.T) {
+	dir := t.TempDir()
+	sourceState, outDir := filepath.Join(dir, "source.json"), filepath.Join(dir, "out")
+	assert.NoError(t, os.WriteFile(sourceState, []byte(runSourceState), 0644))
+
+	internal.Run(internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": "module.iam.aws_iam_role.reader"},
+		Strategy:        internal.StrategyStateSurgery,
+		SourceState:     sourceState,
+		OutDir:          outDir,
+	})
+
+	source := readStateFile(t, filepath.Join(outDir, internal.SourceStateFileName))
+	assert.Equal(t, "source", source["lineage"])
+	assert.Equal(t, float64(4), source["serial"])
+	assert.Len(t, source["resources"], 2)
+
+	target := readStateFile(t, filepath.Join(outDir, internal.TargetStateFileName))
+	assert.NotEqual(t, "source", target["lineage"])
+	assert.Len(t, target["resources"], 1)
+
+	// The input is left as it was
+	assert.Equal(t, float64(3), readStateFile(t, sourceState)["serial"])
+}
+
+func TestRun_StateFilesFromShowJson(t *testing.T) {
+	dir := t.TempDir()
+	sourceState, targetState, outDir := filepath.Join(dir, "show.json"), filepath.Join(dir, "target.tfstate"), filepath.Join(dir, "out")
+	assert.NoError(t, os.WriteFile(sourceState, []byte(showJsonOutput), 0644))
+	assert.NoError(t, os.WriteFile(targetState, []byte(`{"version": 4, "serial": 7, "lineage": "target", "resources": []}`), 0644))
+
+	internal.Run(internal.RunOptions{
+		ResourceMapping: map[string]string{"module.app.aws_ssm_parameter.this": "aws_ssm_parameter.this"},
+		Strategy:        internal.StrategyStateSurgery,
+		SourceState:     sourceState,
+		TargetState:     targetState,
+		OutDir:          outDir,
+	})
+
+	executor := &internal.StateFileExecutor{StateFile: filepath.Join(outDir, internal.TargetStateFileName)}
+	addresses, err := executor.StateList()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`aws_ssm_parameter.this["plain"]`}, addresses)
+
+	target := readStateFile(t, executor.StateFile)
+	assert.Equal(t, "target", target["lineage"])
+	assert.Equal(t, float64(8), target["serial"])
+}
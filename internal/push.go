@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PushOptions holds everything Push needs to push staged states
+type PushOptions struct {
+	SourceDir       string
+	TargetDir       string
+	SourceBinary    string
+	TargetBinary    string
+	SourceWorkspace string
+	TargetWorkspace string
+	CreateWorkspace bool
+	DryRun          bool
+
+	// The staged state files, as written into the output directory
+	SourceStaged string
+	TargetStaged string
+
+	// The executors running Terraform in the source and target directories,
+	// Terraform itself is run in SourceDir and TargetDir when they are not set
+	SourceExecutor Executor
+	TargetExecutor Executor
+}
+
+var (
+	SourceStaged string
+	TargetStaged string
+)
+
+func ParsePushArguments() PushOptions {
+	if ConfigFileName != "" {
+		applyConfigFile(ParseConfigFileContent(OpenConfigFile(ConfigFileName)))
+	}
+
+	if SourceDir == "" || TargetDir == "" {
+		Panic("Both a source directory and a target directory must be specified.")
+	}
+
+	if SourceStaged == "" && OutDir != "" {
+		SourceStaged = filepath.Join(OutDir, SourceStateFileName)
+	}
+	if TargetStaged == "" && OutDir != "" {
+		TargetStaged = filepath.Join(OutDir, TargetStateFileName)
+	}
+	if SourceStaged == "" || TargetStaged == "" {
+		Panic("The staged states must be specified, either with --source and --target or with --out-dir.")
+	}
+	checkFile(SourceStaged)
+	checkFile(TargetStaged)
+
+	defaultBinaries()
+
+	return PushOptions{
+		SourceDir:       SourceDir,
+		TargetDir:       TargetDir,
+		SourceBinary:    SourceBinary,
+		TargetBinary:    TargetBinary,
+		SourceWorkspace: SourceWorkspace,
+		TargetWorkspace: TargetWorkspace,
+		CreateWorkspace: CreateWorkspace,
+		DryRun:          DryRun,
+		SourceStaged:    SourceStaged,
+		TargetStaged:    TargetStaged,
+	}
+}
+
+// VerifyStagedState checks that the live state is still the one the staged state was
+// derived from, as recorded when staging, and that the staged state belongs to it
+func VerifyStagedState(origin StagedOrigin, staged StateDocument, live StateDocument) error {
+	if staged == nil {
+		return errors.New("the staged state is empty")
+	}
+	if origin.ReviewOnly {
+		return errors.New("the staged state is derived from the output of terraform show -json, which is only good for review")
+	}
+	if !origin.Exists {
+		if live != nil {
+			return fmt.Errorf("the staged state is a new state, but there is now a live state with lineage %s", live.Lineage())
+		}
+		return nil
+	}
+	if staged.Lineage() != origin.Lineage {
+		return fmt.Errorf("the staged state has lineage %s, but was derived from a state with lineage %s",
+			staged.Lineage(), origin.Lineage)
+	}
+	if live == nil {
+		return fmt.Errorf("the staged state was derived from a state with lineage %s, but there is no live state", origin.Lineage)
+	}
+	if live.Lineage() != origin.Lineage {
+		return fmt.Errorf("the staged state was derived from a state with lineage %s, but the live state has lineage %s",
+			origin.Lineage, live.Lineage())
+	}
+	if live.Serial() != origin.Serial {
+		return fmt.Errorf("the staged state was derived from serial %d, but the live state is at serial %d",
+			origin.Serial, live.Serial())
+	}
+	return nil
+}
+
+func readStagedState(path string) StateDocument {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		Panic(fmt.Sprintf("The staged state %s could not be read.", path))
+	}
+	staged, err := ParseStateDocument(string(content))
+	if err != nil || staged == nil {
+		Panic(fmt.Sprintf("The staged state %s is not a valid state.", path))
+	}
+	return staged
+}
+
+func verifyLiveState(executor Executor, origin StagedOrigin, staged StateDocument, path string) {
+	content, err := executor.StatePull()
+	if err != nil {
+		Panic(fmt.Sprintf("The state of %s could not be pulled: %v", executor.Dir(), err))
+	}
+	live, err := ParseStateDocument(content)
+	if err != nil {
+		Panic(fmt.Sprintf("The state of %s could not be read.", executor.Dir()))
+	}
+	if err := VerifyStagedState(origin, staged, live); err != nil {
+		Panic(fmt.Sprintf("Refusing to push %s to %s: %v.", path, executor.Dir(), err))
+	}
+}
+
+// Push pushes staged source and target states, after checking that neither
+// live state changed since the staged ones were derived from them
+func Push(options PushOptions) {
+	source, target := options.SourceExecutor, options.TargetExecutor
+	if source == nil {
+		source = newDirectoryExecutor(options.SourceBinary, options.SourceDir, options.SourceWorkspace)
+	}
+	if target == nil {
+		target = newDirectoryExecutor(options.TargetBinary, options.TargetDir, options.TargetWorkspace)
+	}
+
+	target = ensureWorkspaces(source, target, options.CreateWorkspace, options.DryRun)
+
+	// The origins are written next to the staged states
+	originsDir := filepath.Dir(options.SourceStaged)
+	origins, err := ReadStagedOrigins(originsDir)
+	if err != nil {
+		Panic(fmt.Sprintf("The origins of the staged states could not be read from %s: %v",
+			filepath.Join(originsDir, StagedOriginsFileName), err))
+	}
+
+	// Both states are verified before either is pushed
+	verifyLiveState(source, origins.Source, readStagedState(options.SourceStaged), options.SourceStaged)
+	verifyLiveState(target, origins.Target, readStagedState(options.TargetStaged), options.TargetStaged)
+
+	if options.DryRun {
+		fmt.Println(target.CommandLine("state", "push", options.TargetStaged))
+		fmt.Println(source.CommandLine("state", "push", options.SourceStaged))
+		return
+	}
+
+	pushStateFiles(source, options.SourceStaged, target, options.TargetStaged)
+	fmt.Printf("Pushed %s to %s and %s to %s.\n", options.TargetStaged, target.Dir(), options.SourceStaged, source.Dir())
+}
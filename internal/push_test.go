@@ -0,0 +1,72 @@
+package internal_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyStagedState(t *testing.T) {
+	state := func(lineage string, serial int) internal.StateDocument {
+		document, err := internal.ParseStateDocument(
+			fmt.Sprintf(`{"version": 4, "lineage": %q, "serial": %d, "resources": []}`, lineage, serial))
+		assert.NoError(t, err)
+		return document
+	}
+
+	origin := internal.StagedOrigin{Exists: true, Lineage: "live", Serial: 3}
+	assert.NoError(t, internal.VerifyStagedState(origin, state("live", 4), state("live", 3)))
+	// The check does not depend on how many times the serial was bumped while staging
+	assert.NoError(t, internal.VerifyStagedState(origin, state("live", 7), state("live", 3)))
+	assert.NoError(t, internal.VerifyStagedState(internal.StagedOrigin{}, state("new", 1), nil))
+
+	// Someone applied in between
+	assert.ErrorContains(t, internal.VerifyStagedState(origin, state("live", 4), state("live", 4)), "derived from serial 3")
+	assert.ErrorContains(t, internal.VerifyStagedState(origin, state("live", 4), state("other", 3)), "lineage other")
+	assert.Error(t, internal.VerifyStagedState(internal.StagedOrigin{}, state("new", 1), state("live", 0)))
+	assert.Error(t, internal.VerifyStagedState(origin, state("live", 4), nil))
+	// The staged state does not belong to the origin
+	assert.Error(t, internal.VerifyStagedState(origin, state("other", 4), state("live", 3)))
+	assert.ErrorContains(t, internal.VerifyStagedState(internal.StagedOrigin{Exists: true, ReviewOnly: true},
+		state("new", 1), state("live", 3)), "show -json")
+}
+
+func TestPush(t *testing.T) {
+	fake := faketerraform.New(t)
+	sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+
+	// Stage the transfer from a copy of the live source state
+	sourceState, outDir := filepath.Join(t.TempDir(), "source.tfstate"), t.TempDir()
+	assert.NoError(t, os.WriteFile(sourceState, []byte(runSourceState), 0644))
+	internal.Run(internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+		Strategy:        internal.StrategyStateSurgery,
+		SourceState:     sourceState,
+		OutDir:          outDir,
+	})
+	origins, err := internal.ReadStagedOrigins(outDir)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.StagedOrigins{Source: internal.StagedOrigin{Exists: true, Lineage: "source", Serial: 3}}, origins)
+
+	// Staging leaves the live states alone
+	assert.ElementsMatch(t, []string{"aws_iam_role.reader", "aws_iam_role.writer",
+		`aws_ssm_parameter.this["it's"]`, `aws_ssm_parameter.this["plain"]`}, fake.Addresses(sourceDir))
+
+	internal.Push(internal.PushOptions{
+		SourceStaged:   filepath.Join(outDir, internal.SourceStateFileName),
+		TargetStaged:   filepath.Join(outDir, internal.TargetStateFileName),
+		SourceExecutor: &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: sourceDir},
+		TargetExecutor: &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: targetDir},
+	})
+
+	assert.Equal(t, []string{"aws_iam_role.reader"}, fake.Addresses(targetDir))
+	assert.ElementsMatch(t, []string{"aws_iam_role.writer",
+		`aws_ssm_parameter.this["it's"]`, `aws_ssm_parameter.this["plain"]`}, fake.Addresses(sourceDir))
+	assert.Equal(t, "source", fake.State(sourceDir)["lineage"])
+	assert.Equal(t, float64(4), fake.State(sourceDir)["serial"])
+}
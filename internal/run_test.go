@@ -0,0 +1,237 @@
+package internal_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	faketerraform.Main()
+	os.Exit(m.Run())
+}
+
+const runSourceState = `
+{
+  "version": 4,
+  "serial": 3,
+  "lineage": "source",
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_iam_role",
+      "name": "reader",
+      "instances": [{"schema_version": 0, "attributes": {"id": "reader"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_iam_role",
+      "name": "writer",
+      "instances": [{"schema_version": 0, "attributes": {"id": "writer"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_ssm_parameter",
+      "name": "this",
+      "instances": [
+        {"index_key": "it's", "schema_version": 0, "attributes": {"id": "/app/quoted"}},
+        {"index_key": "plain", "schema_version": 0, "attributes": {"id": "/app/plain"}}
+      ]
+    }
+  ]
+}
+`
+
+func runWithFake(fake *faketerraform.Fake, sourceDir string, targetDir string, options internal.RunOptions) {
+	options.SourceExecutor = &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: sourceDir}
+	options.TargetExecutor = &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: targetDir}
+	internal.Run(options)
+}
+
+// panicTestEnv names the test run again in a subprocess by expectPanic
+const panicTestEnv = "TFSTATE_TRANSFER_PANIC_TEST"
+
+// expectPanic runs the test again in a subprocess, as Panic exits the process,
+// and checks that run exits there with an error. It returns what run printed.
+func expectPanic(t *testing.T, run func()) string {
+	if os.Getenv(panicTestEnv) == t.Name() {
+		run()
+		os.Exit(0)
+	}
+
+	command := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$")
+	command.Env = append(os.Environ(), panicTestEnv+"="+t.Name())
+	output, err := command.CombinedOutput()
+	var exitError *exec.ExitError
+	assert.True(t, errors.As(err, &exitError), "expected the run to exit with an error, it printed:\n%s", output)
+	return string(output)
+}
+
+// captureOutput returns what run prints on the standard output
+func captureOutput(t *testing.T, run func()) string {
+	reader, writer, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		output <- string(content)
+	}()
+	run()
+	assert.NoError(t, writer.Close())
+	return <-output
+}
+
+func TestRun_Import(t *testing.T) {
+	fake := faketerraform.New(t)
+	fake.AddObject("aws_iam_role", "reader", nil)
+	fake.AddObject("aws_ssm_parameter", "/app/quoted", nil)
+	fake.AddObject("aws_ssm_parameter", "/app/plain", nil)
+	sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+
+	runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"aws_iam_role.reader":    "module.iam.aws_iam_role.reader",
+			"aws_ssm_parameter.this": "aws_ssm_parameter.this",
+		},
+		Strategy: internal.StrategyImport,
+	})
+
+	assert.ElementsMatch(t, []string{
+		"module.iam.aws_iam_role.reader",
+		`aws_ssm_parameter.this["it's"]`,
+		`aws_ssm_parameter.this["plain"]`,
+	}, fake.Addresses(targetDir))
+	assert.Equal(t, []string{"aws_iam_role.writer"}, fake.Addresses(sourceDir))
+}
+
+func TestRun_ImportFailures(t *testing.T) {
+	fake := faketerraform.New(t)
+	fake.AddObject("aws_iam_role", "reader", nil)
+	fake.AddObject("aws_iam_role", "writer", nil)
+	fake.Unsupported("aws_ssm_parameter")
+	// The writer hits a lock, the run goes on with the other resources
+	fake.Fail(faketerraform.Failure{Command: "import", Address: "aws_iam_role.writer", Kind: faketerraform.FailLock, Times: 1})
+
+	sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+	runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+		ResourceMapping: map[string]string{
+			"aws_iam_role.*":         "aws_iam_role.$1",
+			"aws_ssm_parameter.this": "aws_ssm_parameter.this",
+		},
+		Strategy: internal.StrategyImport,
+	})
+
+	assert.ElementsMatch(t, []string{"aws_iam_role.reader"}, fake.Addresses(targetDir))
+	// Nothing that failed to import is removed from the source
+	assert.ElementsMatch(t, []string{
+		"aws_iam_role.writer",
+		`aws_ssm_parameter.this["it's"]`,
+		`aws_ssm_parameter.this["plain"]`,
+	}, fake.Addresses(sourceDir))
+}
+
+func TestRun_AlreadyManaged(t *testing.T) {
+	// OpenTofu words the failure after itself
+	for _, version := range []string{faketerraform.DefaultVersion, "OpenTofu v1.8.0"} {
+		fake := faketerraform.New(t)
+		fake.SetVersion(version)
+		sourceDir := fake.WorkingDir(runSourceState)
+		targetDir := fake.WorkingDir(`{"version": 4, "serial": 1, "lineage": "target", "resources": [
+  {"mode": "managed", "type": "aws_iam_role", "name": "reader", "instances": [{"attributes": {"id": "reader"}}]}
+]}`)
+
+		runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+			ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+			Strategy:        internal.StrategyImport,
+		})
+
+		assert.Equal(t, []string{"aws_iam_role.reader"}, fake.Addresses(targetDir), version)
+		assert.NotContains(t, fake.Addresses(sourceDir), "aws_iam_role.reader", version)
+	}
+}
+
+func TestRun_StateSurgery(t *testing.T) {
+	fake := faketerraform.New(t)
+	sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+
+	runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_ssm_parameter.this": "module.app.aws_ssm_parameter.this"},
+		Strategy:        internal.StrategyStateSurgery,
+	})
+
+	assert.ElementsMatch(t, []string{
+		`module.app.aws_ssm_parameter.this["it's"]`,
+		`module.app.aws_ssm_parameter.this["plain"]`,
+	}, fake.Addresses(targetDir))
+	assert.ElementsMatch(t, []string{"aws_iam_role.reader", "aws_iam_role.writer"}, fake.Addresses(sourceDir))
+	assert.Equal(t, float64(4), fake.State(sourceDir)["serial"])
+	assert.Equal(t, "source", fake.State(sourceDir)["lineage"])
+}
+
+func TestRun_StateSurgeryDryRun(t *testing.T) {
+	fake := faketerraform.New(t)
+	sourceDir, targetDir := fake.WorkingDir(runSourceState), fake.WorkingDir("")
+	// The rewritten states hold secrets, a dry run must not leave them behind
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	output := captureOutput(t, func() {
+		runWithFake(fake, sourceDir, targetDir, internal.RunOptions{
+			ResourceMapping: map[string]string{"aws_ssm_parameter.this": "module.app.aws_ssm_parameter.this"},
+			Strategy:        internal.StrategyStateSurgery,
+			DryRun:          true,
+		})
+	})
+
+	assert.Contains(t, output, "<rewritten state of "+targetDir+">")
+	assert.Contains(t, output, "<rewritten state of "+sourceDir+">")
+	entries, err := os.ReadDir(tempDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Len(t, fake.Addresses(sourceDir), 4)
+	assert.NoFileExists(t, filepath.Join(targetDir, faketerraform.StateFile))
+}
+
+func TestRun_EmptySourceState(t *testing.T) {
+	for _, strategy := range []string{internal.StrategyImport, internal.StrategyStateSurgery} {
+		t.Run(strategy, func(t *testing.T) {
+			output := expectPanic(t, func() {
+				fake := faketerraform.New(t)
+				runWithFake(fake, fake.WorkingDir(""), fake.WorkingDir(""), internal.RunOptions{
+					ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+					Strategy:        strategy,
+				})
+			})
+			assert.Contains(t, output, "could not be read: the state is empty")
+			assert.NotContains(t, output, "panic:")
+		})
+	}
+
+	t.Run("offline", func(t *testing.T) {
+		output := expectPanic(t, func() {
+			sourceState := filepath.Join(t.TempDir(), "source.tfstate")
+			assert.NoError(t, os.WriteFile(sourceState, []byte(`{"version": 4, "lineage": "source"}`), 0644))
+			internal.Run(internal.RunOptions{
+				ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+				Strategy:        internal.StrategyStateSurgery,
+				SourceState:     sourceState,
+				DryRun:          true,
+			})
+		})
+		assert.Contains(t, output, "could not be read: the state does not contain any resources")
+		assert.NotContains(t, output, "panic:")
+	})
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// SameState tells whether the source and the target are the same state, either because
+// they are the same directory and workspace, or because both pull the same state.
+// It fails when the states share a lineage but differ, as there is then no telling
+// whether they are two copies of one state or one state that changed in between.
+func SameState(source Executor, sourceStateContent string, target Executor, targetStateContent string) (bool, error) {
+	if source.Dir() == target.Dir() && source.Workspace() == target.Workspace() {
+		return true, nil
+	}
+
+	sourceState, err := ParseStateDocument(sourceStateContent)
+	if err != nil {
+		return false, fmt.Errorf("the state of %s could not be read, so it cannot be told apart from the state of %s: %v",
+			source.Dir(), target.Dir(), err)
+	}
+	targetState, err := ParseStateDocument(targetStateContent)
+	if err != nil {
+		return false, fmt.Errorf("the state of %s could not be read, so it cannot be told apart from the state of %s: %v",
+			target.Dir(), source.Dir(), err)
+	}
+	if sourceState == nil || targetState == nil {
+		// A state that does not exist yet is another state
+		return false, nil
+	}
+
+	if sourceState.Lineage() == "" || sourceState.Lineage() != targetState.Lineage() {
+		return false, nil
+	}
+	if reflect.DeepEqual(sourceState, targetState) {
+		return true, nil
+	}
+	return false, errors.New("the source and target states share the lineage " + sourceState.Lineage() +
+		" but differ, they may be copies of one state or a state that changed while being read")
+}
+
+// transferSameState renames the resources within the one state they already are in
+func transferSameState(rn *RunHandler, executor Executor, dryRunSet map[string]*DryRunSet) {
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		command := executor.CommandLine("state", "mv", resource.sourceName, resource.targetName)
+
+		var err error
+		if dryRunSet != nil {
+			dryRunSet[resource.topLevelName].AddImportCommand(command)
+		} else if err = executor.StateMv(resource.sourceName, resource.targetName); err != nil {
+			err = fmt.Errorf("failed to move the resource: %v", err)
+		}
+		rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, err)
+	}
+}
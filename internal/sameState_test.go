@@ -0,0 +1,61 @@
+package internal_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameState(t *testing.T) {
+	source := internal.NewTerraformExecutor("terraform", "source")
+	target := internal.NewTerraformExecutor("terraform", "target")
+
+	same, err := internal.SameState(source, runSourceState, source, "")
+	assert.Nil(t, err)
+	assert.True(t, same)
+
+	// Two directories sharing one backend pull the very same state
+	same, err = internal.SameState(source, runSourceState, target, runSourceState)
+	assert.Nil(t, err)
+	assert.True(t, same)
+
+	same, err = internal.SameState(source, runSourceState, target, strings.Replace(runSourceState, `"source"`, `"target"`, 1))
+	assert.Nil(t, err)
+	assert.False(t, same)
+
+	same, err = internal.SameState(source, runSourceState, target, "")
+	assert.Nil(t, err)
+	assert.False(t, same)
+
+	// A state that cannot be read, such as an error printed instead, is refused
+	_, err = internal.SameState(source, runSourceState, target, "Error: Failed to load state")
+	assert.NotNil(t, err)
+
+	// A copy of the state that has since moved on cannot be told apart from the same state
+	_, err = internal.SameState(source, runSourceState, target, strings.Replace(runSourceState, `"serial": 3`, `"serial": 4`, 1))
+	assert.NotNil(t, err)
+}
+
+func TestRun_SameState(t *testing.T) {
+	fake := faketerraform.New(t)
+	dir := fake.WorkingDir(runSourceState)
+
+	runWithFake(fake, dir, dir, internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_ssm_parameter.this": "module.app.aws_ssm_parameter.this"},
+		Strategy:        internal.StrategyImport,
+	})
+
+	assert.ElementsMatch(t, []string{
+		"aws_iam_role.reader",
+		"aws_iam_role.writer",
+		`module.app.aws_ssm_parameter.this["it's"]`,
+		`module.app.aws_ssm_parameter.this["plain"]`,
+	}, fake.Addresses(dir))
+	for _, call := range fake.Calls() {
+		command := strings.Join(call.Args, " ")
+		assert.False(t, strings.HasPrefix(command, "import") || strings.HasPrefix(command, "state rm"), command)
+	}
+}
@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kassett/tfstate-transfer/internal/address"
+)
+
+// StateDocument is a pulled Terraform state kept as raw JSON, so that
+// every field this tool does not know about survives the round trip
+type StateDocument map[string]interface{}
+
+type instanceAddress struct {
+	module       string
+	mode         string
+	resourceType string
+	name         string
+	indexKey     interface{}
+}
+
+func ParseStateDocument(stateFileContent string) (StateDocument, error) {
+	if strings.TrimSpace(stateFileContent) == "" {
+		// A directory that has never been applied has no state yet
+		return nil, nil
+	}
+
+	var document StateDocument
+	decoder := json.NewDecoder(strings.NewReader(stateFileContent))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	if _, ok := document["resources"].([]interface{}); !ok {
+		document["resources"] = []interface{}{}
+	}
+	return document, nil
+}
+
+// NewStateDocument creates an empty state with a fresh lineage,
+// borrowing the format versions from an existing state
+func NewStateDocument(template StateDocument) StateDocument {
+	return StateDocument{
+		"version":           template["version"],
+		"terraform_version": template["terraform_version"],
+		"serial":            json.Number("0"),
+		"lineage":           newLineage(),
+		"outputs":           map[string]interface{}{},
+		"resources":         []interface{}{},
+	}
+}
+
+func newLineage() string {
+	buffer := make([]byte, 16)
+	_, _ = rand.Read(buffer)
+	buffer[6] = (buffer[6] & 0x0f) | 0x40
+	buffer[8] = (buffer[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buffer[0:4], buffer[4:6], buffer[6:8], buffer[8:10], buffer[10:])
+}
+
+func (d StateDocument) Lineage() string {
+	lineage, _ := d["lineage"].(string)
+	return lineage
+}
+
+func (d StateDocument) Serial() int64 {
+	serial, _ := strconv.ParseInt(fmt.Sprint(d["serial"]), 10, 64)
+	return serial
+}
+
+func (d StateDocument) BumpSerial() {
+	d["serial"] = json.Number(strconv.FormatInt(d.Serial()+1, 10))
+}
+
+func (d StateDocument) resources() []interface{} {
+	resources, _ := d["resources"].([]interface{})
+	return resources
+}
+
+func (d StateDocument) findResource(address instanceAddress) (int, map[string]interface{}) {
+	for i, res := range d.resources() {
+		resMap, ok := res.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		module, _ := resMap["module"].(string)
+		if module == address.module && resMap["mode"] == address.mode &&
+			resMap["type"] == address.resourceType && resMap["name"] == address.name {
+			return i, resMap
+		}
+	}
+	return -1, nil
+}
+
+func findInstance(resMap map[string]interface{}, indexKey interface{}) (int, map[string]interface{}) {
+	instances, _ := resMap["instances"].([]interface{})
+	for i, inst := range instances {
+		instMap, ok := inst.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if indexKeysEqual(instMap["index_key"], indexKey) {
+			return i, instMap
+		}
+	}
+	return -1, nil
+}
+
+func indexKeysEqual(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	aString, aIsString := a.(string)
+	bString, bIsString := b.(string)
+	if aIsString || bIsString {
+		return aIsString && bIsString && aString == bString
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// MoveInstance takes a single resource instance out of the source state
+// and places it into the target state under its new address
+func MoveInstance(source StateDocument, target StateDocument, sourceName string, targetName string) error {
+	sourceAddress, err := parseInstanceAddress(sourceName)
+	if err != nil {
+		return err
+	}
+	targetAddress, err := parseInstanceAddress(targetName)
+	if err != nil {
+		return err
+	}
+
+	sourceIndex, sourceResource := source.findResource(sourceAddress)
+	if sourceResource == nil {
+		return fmt.Errorf("resource %s was not found in the source state", sourceName)
+	}
+	instanceIndex, instance := findInstance(sourceResource, sourceAddress.indexKey)
+	if instance == nil {
+		return fmt.Errorf("resource %s was not found in the source state", sourceName)
+	}
+
+	_, targetResource := target.findResource(targetAddress)
+	if targetResource != nil {
+		if _, existing := findInstance(targetResource, targetAddress.indexKey); existing != nil {
+			return fmt.Errorf("resource %s already exists in the target state", targetName)
+		}
+	} else {
+		targetResource = map[string]interface{}{
+			"mode":      targetAddress.mode,
+			"type":      targetAddress.resourceType,
+			"name":      targetAddress.name,
+			"provider":  sourceResource["provider"],
+			"instances": []interface{}{},
+		}
+		if targetAddress.module != "" {
+			targetResource["module"] = targetAddress.module
+		}
+		target["resources"] = append(target.resources(), targetResource)
+	}
+
+	// Take the instance out of the source
+	sourceInstances := sourceResource["instances"].([]interface{})
+	sourceInstances = append(sourceInstances[:instanceIndex], sourceInstances[instanceIndex+1:]...)
+	if len(sourceInstances) == 0 {
+		resources := source.resources()
+		source["resources"] = append(resources[:sourceIndex], resources[sourceIndex+1:]...)
+	} else {
+		sourceResource["instances"] = sourceInstances
+	}
+
+	// The dependencies refer to addresses in the source configuration
+	delete(instance, "dependencies")
+	if targetAddress.indexKey == nil {
+		delete(instance, "index_key")
+	} else {
+		instance["index_key"] = targetAddress.indexKey
+	}
+	targetResource["instances"] = append(targetResource["instances"].([]interface{}), instance)
+
+	return nil
+}
+
+func parseInstanceAddress(resourceName string) (instanceAddress, error) {
+	parsed := instanceAddress{}
+	resourceAddress, err := address.Parse(resourceName)
+	if err != nil {
+		return parsed, err
+	}
+
+	resource := resourceAddress.Resource()
+	if resource == nil {
+		return parsed, fmt.Errorf("address %s does not point to a resource instance", resourceName)
+	}
+
+	parsed.module = resourceAddress.ModulePath().String()
+	parsed.mode = resource.Mode
+	parsed.resourceType = resource.Type
+	parsed.name = resource.Name
+	if resource.Key != nil {
+		parsed.indexKey = resource.Key.Value()
+	}
+	return parsed, nil
+}
+
+// writeStateDocument writes the document into a temporary state file, for terraform state push
+func writeStateDocument(document StateDocument) (string, error) {
+	stateFile, err := os.CreateTemp("", "tfstate-transfer-*.tfstate")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = stateFile.Close()
+	}()
+
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return stateFile.Name(), err
+	}
+	_, err = stateFile.Write(content)
+	return stateFile.Name(), err
+}
+
+// dryRunStateFile stands in for the rewritten state in the commands of a dry run,
+// which does not write the state, secrets included, anywhere
+func dryRunStateFile(executor Executor) string {
+	return fmt.Sprintf("<rewritten state of %s>", executor.Dir())
+}
+
+func pushStateDocument(executor Executor, document StateDocument, dryRun bool) (string, error) {
+	if dryRun {
+		return executor.CommandLine("state", "push", dryRunStateFile(executor)), nil
+	}
+
+	stateFile, err := writeStateDocument(document)
+	defer removeStateFile(stateFile)
+	if err != nil {
+		return "", err
+	}
+	return executor.CommandLine("state", "push", stateFile), executor.StatePush(stateFile)
+}
+
+// removeStateFile removes a state file written by writeStateDocument, if any
+func removeStateFile(stateFile string) {
+	if stateFile != "" {
+		_ = os.Remove(stateFile)
+	}
+}
+
+// pushStateFiles pushes the state files of a transfer. The target goes first: if the
+// source push fails afterwards, the resources are managed twice rather than not at all
+func pushStateFiles(source Executor, sourceFile string, target Executor, targetFile string) {
+	if err := target.StatePush(targetFile); err != nil {
+		Panic(fmt.Sprintf("Failed to push the state of %s: %v", target.Dir(), err))
+	}
+	if err := source.StatePush(sourceFile); err != nil {
+		Panic(fmt.Sprintf("Failed to push the state of %s, the moved resources are now in both states: %v", source.Dir(), err))
+	}
+}
+
+func transferStateSurgery(rn *RunHandler, source Executor, target Executor, sourceStateContent string, dryRunSet map[string]*DryRunSet) {
+	dryRun := dryRunSet != nil
+
+	sourceState, err := ParseStateDocument(sourceStateContent)
+	if err != nil || sourceState == nil {
+		Panic(fmt.Sprintf("The state of %s could not be read.", source.Dir()))
+	}
+	targetState, err := ParseStateDocument(generateStateFile(target))
+	if err != nil {
+		Panic(fmt.Sprintf("The state of %s could not be read.", target.Dir()))
+	}
+	if targetState == nil {
+		targetState = NewStateDocument(sourceState)
+	}
+
+	// Resources that stay in the source are taken from a scratch copy of it
+	scratchState, _ := ParseStateDocument(sourceStateContent)
+
+	moved := 0
+	for rn.HasNextResource() {
+		resource, _ := rn.GetNextResource()
+		from := sourceState
+		if rn.skipRemove[resource.topLevelName] {
+			from = scratchState
+		}
+		err := MoveInstance(from, targetState, resource.sourceName, resource.targetName)
+		if err == nil {
+			moved++
+		}
+
+		rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, err)
+
+		if dryRun {
+			dryRunSet[resource.topLevelName].AddImportCommand(
+				fmt.Sprintf("move '%s' to '%s'", resource.sourceName, resource.targetName))
+		}
+	}
+
+	if moved == 0 {
+		return
+	}
+
+	sourceState.BumpSerial()
+	targetState.BumpSerial()
+
+	if dryRun {
+		for _, dryRunEntry := range dryRunSet {
+			dryRunEntry.AddImportCommand(target.CommandLine("state", "push", dryRunStateFile(target)))
+			dryRunEntry.AddDeleteCommand(source.CommandLine("state", "push", dryRunStateFile(source)))
+		}
+		return
+	}
+
+	targetFile, err := writeStateDocument(targetState)
+	defer removeStateFile(targetFile)
+	if err != nil {
+		Panic(fmt.Sprintf("Failed to write the state of %s: %v", target.Dir(), err))
+	}
+	sourceFile, err := writeStateDocument(sourceState)
+	defer removeStateFile(sourceFile)
+	if err != nil {
+		Panic(fmt.Sprintf("Failed to write the state of %s: %v", source.Dir(), err))
+	}
+	pushStateFiles(source, sourceFile, target, targetFile)
+}
+
+// transferCopies copies resources that cannot be imported straight into the
+// target state, leaving their removal from the source to the usual flow
+func transferCopies(rn *RunHandler, source Executor, target Executor, copies []*ImportObject, dryRunSet map[string]*DryRunSet) {
+	dryRun := dryRunSet != nil
+
+	// The source document is only a scratch copy, it is never pushed back
+	sourceState, err := ParseStateDocument(generateStateFile(source))
+	if err != nil || sourceState == nil {
+		Panic(fmt.Sprintf("The state of %s could not be read.", source.Dir()))
+	}
+	targetState, err := ParseStateDocument(generateStateFile(target))
+	if err != nil {
+		Panic(fmt.Sprintf("The state of %s could not be read.", target.Dir()))
+	}
+	if targetState == nil {
+		targetState = NewStateDocument(sourceState)
+	}
+
+	results := make(map[string]error)
+	copied := 0
+	for _, resource := range copies {
+		results[resource.sourceName] = MoveInstance(sourceState, targetState, resource.sourceName, resource.targetName)
+		if results[resource.sourceName] == nil {
+			copied++
+		}
+	}
+
+	if copied > 0 {
+		targetState.BumpSerial()
+		command, err := pushStateDocument(target, targetState, dryRun)
+		if err != nil {
+			for _, resource := range copies {
+				if results[resource.sourceName] == nil {
+					results[resource.sourceName] = fmt.Errorf("failed to push the target state: %v", err)
+				}
+			}
+		}
+		if dryRun {
+			pushed := make(map[string]bool)
+			for _, resource := range copies {
+				dryRunSet[resource.topLevelName].AddImportCommand(
+					fmt.Sprintf("copy '%s' to '%s'", resource.sourceName, resource.targetName))
+			}
+			for _, resource := range copies {
+				if !pushed[resource.topLevelName] {
+					dryRunSet[resource.topLevelName].AddImportCommand(command)
+					pushed[resource.topLevelName] = true
+				}
+			}
+		}
+	}
+
+	for _, resource := range copies {
+		rn.ReportImportRun(resource.sourceName, resource.targetName, resource.topLevelName, results[resource.sourceName])
+	}
+}
@@ -0,0 +1,95 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+const surgerySourceState = `
+{
+  "version": 4,
+  "terraform_version": "1.9.0",
+  "serial": 7,
+  "lineage": "source-lineage",
+  "outputs": {},
+  "resources": [
+    {
+      "module": "module.table_count[0]",
+      "mode": "managed",
+      "type": "aws_dynamodb_table",
+      "name": "this",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {"schema_version": 1, "attributes": {"id": "case3-1"}, "dependencies": ["aws_kms_key.this"]}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_secretsmanager_secret",
+      "name": "iterate_foreach",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {"index_key": "one", "schema_version": 0, "attributes": {"id": "one"}},
+        {"index_key": "two", "schema_version": 0, "attributes": {"id": "two"}}
+      ]
+    }
+  ]
+}
+`
+
+func TestMoveInstance(t *testing.T) {
+	source, err := internal.ParseStateDocument(surgerySourceState)
+	assert.Nil(t, err)
+	target := internal.NewStateDocument(source)
+
+	err = internal.MoveInstance(source, target,
+		"module.table_count[0].aws_dynamodb_table.this", "module.tables[\"one\"].aws_dynamodb_table.main")
+	assert.Nil(t, err)
+
+	err = internal.MoveInstance(source, target,
+		"aws_secretsmanager_secret.iterate_foreach[\"two\"]", "aws_secretsmanager_secret.this")
+	assert.Nil(t, err)
+
+	// The emptied resource disappears, the partially moved one keeps its other instance
+	sourceResources := source["resources"].([]interface{})
+	assert.Len(t, sourceResources, 1)
+	assert.Len(t, sourceResources[0].(map[string]interface{})["instances"], 1)
+
+	targetResources := target["resources"].([]interface{})
+	assert.Len(t, targetResources, 2)
+
+	table := targetResources[0].(map[string]interface{})
+	assert.Equal(t, "module.tables[\"one\"]", table["module"])
+	assert.Equal(t, "main", table["name"])
+	tableInstance := table["instances"].([]interface{})[0].(map[string]interface{})
+	assert.NotContains(t, tableInstance, "dependencies")
+
+	secretInstance := targetResources[1].(map[string]interface{})["instances"].([]interface{})[0].(map[string]interface{})
+	assert.NotContains(t, secretInstance, "index_key")
+}
+
+func TestMoveInstance_Conflicts(t *testing.T) {
+	source, _ := internal.ParseStateDocument(surgerySourceState)
+	target, _ := internal.ParseStateDocument(surgerySourceState)
+
+	err := internal.MoveInstance(source, target,
+		"aws_secretsmanager_secret.iterate_foreach[\"one\"]", "aws_secretsmanager_secret.iterate_foreach[\"two\"]")
+	assert.NotNil(t, err)
+
+	err = internal.MoveInstance(source, target,
+		"aws_secretsmanager_secret.missing", "aws_secretsmanager_secret.missing")
+	assert.NotNil(t, err)
+
+	// Nothing was taken out of the source
+	assert.Len(t, source["resources"], 2)
+}
+
+func TestStateDocument_BumpSerial(t *testing.T) {
+	document, _ := internal.ParseStateDocument(surgerySourceState)
+	document.BumpSerial()
+
+	assert.Equal(t, int64(8), document.Serial())
+	assert.Equal(t, "source-lineage", document.Lineage())
+}
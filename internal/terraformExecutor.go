@@ -1,47 +1,285 @@
 package internal
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
+	"sync"
 )
 
-func executeCommand(command string, directory string) (string, error) {
-	cmd := exec.Command("bash", "-c", command)
-	cmd.Dir = directory
-	output, err := cmd.CombinedOutput()
+// Executor runs Terraform commands in a single working directory.
+// Addresses and identifiers are passed as separate arguments and never
+// go through a shell, so they may contain any character.
+type Executor interface {
+	// Dir is the working directory the commands run in
+	Dir() string
+	// CommandLine renders the command running the arguments, for dry runs and errors
+	CommandLine(args ...string) string
+
+	StatePull() (string, error)
+	StatePush(stateFile string) error
+	StateList() ([]string, error)
+	StateRm(address string) error
+	StateMv(source string, target string) error
+	Import(address string, id string) (string, error)
+	// Plan writes a plan of the given targets to the plan file, with machine-readable output
+	Plan(planFile string, targets []string) (string, error)
+	// Apply applies a saved plan, with machine-readable output
+	Apply(planFile string) (string, error)
+	// Version probes the product and version of the binary
+	Version() (BinaryVersion, error)
+
+	// Workspace is the workspace the commands run against, empty for the selected one
+	Workspace() string
+	// EnsureWorkspace checks that the workspace exists, creating it when asked to
+	EnsureWorkspace(create bool) error
+}
+
+// TerraformExecutor invokes the terraform (or tofu, or terragrunt) binary directly
+type TerraformExecutor struct {
+	Binary     string
+	WorkingDir string
+	// Env is added to the environment of every command
+	Env []string
+	// WorkspaceName is passed as TF_WORKSPACE, so that the selected workspace is left alone
+	WorkspaceName string
+
+	version *BinaryVersion
+}
+
+// NewTerraformExecutor runs the given binary in the directory, or the one detected there,
+// through Terragrunt when the directory is managed by Terragrunt
+func NewTerraformExecutor(binary string, dir string) *TerraformExecutor {
+	if binary == "" {
+		binary = DetectBinary(dir)
+	}
+	if binary != BinaryTerragrunt && IsTerragruntDir(dir) {
+		return NewTerragruntExecutor(binary, dir)
+	}
+	return &TerraformExecutor{Binary: binary, WorkingDir: dir}
+}
+
+// NewTerragruntExecutor runs Terragrunt in the directory, which runs the given binary
+// in its cache directory with the same arguments
+func NewTerragruntExecutor(binary string, dir string) *TerraformExecutor {
+	return &TerraformExecutor{
+		Binary:     BinaryTerragrunt,
+		WorkingDir: dir,
+		// Terragrunt renamed its settings, older versions read the first ones
+		Env: []string{
+			"TERRAGRUNT_TFPATH=" + binary,
+			"TERRAGRUNT_NON_INTERACTIVE=true",
+			"TG_TF_PATH=" + binary,
+			"TG_NON_INTERACTIVE=true",
+		},
+	}
+}
+
+func (e *TerraformExecutor) Dir() string {
+	return e.WorkingDir
+}
+
+func (e *TerraformExecutor) CommandLine(args ...string) string {
+	command := shellJoin(append([]string{e.Binary}, args...))
+	if e.WorkspaceName != "" {
+		command = "TF_WORKSPACE=" + shellQuote(e.WorkspaceName) + " " + command
+	}
+	return command
+}
+
+func (e *TerraformExecutor) run(args ...string) (string, error) {
+	env := e.Env
+	if e.WorkspaceName != "" {
+		env = append(append([]string{}, env...), "TF_WORKSPACE="+e.WorkspaceName)
+	}
+	return executeCommand(e.WorkingDir, env, e.Binary, args...)
+}
+
+func (e *TerraformExecutor) Workspace() string {
+	return e.WorkspaceName
+}
+
+// MissingWorkspaceError is returned by EnsureWorkspace when the workspace does not exist
+type MissingWorkspaceError struct {
+	Workspace string
+	Dir       string
+}
+
+func (e *MissingWorkspaceError) Error() string {
+	return fmt.Sprintf("the workspace %s does not exist in %s", e.Workspace, e.Dir)
+}
+
+func (e *TerraformExecutor) EnsureWorkspace(create bool) error {
+	if e.WorkspaceName == "" {
+		return nil
+	}
+
+	// Terraform refuses to manage workspaces while TF_WORKSPACE is set
+	output, err := executeCommand(e.WorkingDir, e.Env, e.Binary, "workspace", "list")
 	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*")) == e.WorkspaceName {
+			return nil
+		}
+	}
+
+	if !create {
+		return &MissingWorkspaceError{Workspace: e.WorkspaceName, Dir: e.WorkingDir}
+	}
+	_, err = executeCommand(e.WorkingDir, e.Env, e.Binary, "workspace", "new", e.WorkspaceName)
+	return err
+}
+
+func (e *TerraformExecutor) StatePull() (string, error) {
+	return e.run("state", "pull")
+}
+
+func (e *TerraformExecutor) StatePush(stateFile string) error {
+	_, err := e.run("state", "push", stateFile)
+	return err
+}
+
+func (e *TerraformExecutor) StateList() ([]string, error) {
+	output, err := e.run("state", "list")
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			addresses = append(addresses, line)
+		}
+	}
+	return addresses, nil
+}
+
+func (e *TerraformExecutor) StateRm(address string) error {
+	_, err := e.run("state", "rm", address)
+	return err
+}
+
+func (e *TerraformExecutor) StateMv(source string, target string) error {
+	_, err := e.run("state", "mv", source, target)
+	return err
+}
+
+func (e *TerraformExecutor) Import(address string, id string) (string, error) {
+	return e.run("import", "-input=false", address, id)
+}
+
+func (e *TerraformExecutor) Plan(planFile string, targets []string) (string, error) {
+	return e.run(append([]string{"plan", "-json", "-input=false", "-out=" + planFile}, targetArguments(targets)...)...)
+}
+
+func (e *TerraformExecutor) Apply(planFile string) (string, error) {
+	return e.run("apply", "-json", "-input=false", planFile)
+}
+
+func (e *TerraformExecutor) Version() (BinaryVersion, error) {
+	if e.version != nil {
+		return *e.version, nil
+	}
+	output, err := e.run("version")
+	if err != nil {
+		return BinaryVersion{}, err
+	}
+	version, err := ParseBinaryVersion(output)
+	if err != nil {
+		return BinaryVersion{}, err
+	}
+	e.version = &version
+	return version, nil
+}
+
+func targetArguments(targets []string) []string {
+	arguments := make([]string, 0, len(targets))
+	for _, target := range targets {
+		arguments = append(arguments, "-target="+target)
+	}
+	return arguments
+}
+
+// lockedBuffer lets the standard output and the standard error, which exec.Cmd copies
+// from separate goroutines, be written into one buffer in the order they arrive
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// executeCommand returns the standard output of the command when it succeeds, as wrappers
+// such as Terragrunt log to the standard error, and the combined output when it fails
+func executeCommand(directory string, env []string, name string, args ...string) (string, error) {
+	stdout, combined := bytes.Buffer{}, &lockedBuffer{}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = directory
+	cmd.Stdout = io.MultiWriter(&stdout, combined)
+	cmd.Stderr = combined
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	if err := cmd.Run(); err != nil {
 		// Return both the error and the combined output
-		return string(output), fmt.Errorf("error: %v, output: %s", err, string(output))
+		return combined.String(), fmt.Errorf("error: %v, output: %s", err, combined.String())
+	}
+	return stdout.String(), nil
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes an argument so that it can be pasted into a shell as is
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
 	}
-	return string(output), nil
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
 }
-func generateStateFile(sourceDir string) string {
-	command := "terraform state pull"
-	output, err := executeCommand(command, sourceDir)
+
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func generateStateFile(executor Executor) string {
+	output, err := executor.StatePull()
 	if err != nil {
 		fmt.Print(err)
 	}
 	return output
 }
 
-func runImport(targetDir string, importObject ImportObject, dryRun bool) (string, error) {
-	defaultError := errors.New("unknown error: try importing manually")
-
-	for _, field := range ImportIdentifierFields {
-		id, exists := importObject.identifier[field]
-		if !exists || id == nil {
-			continue
-		}
+func runImport(executor Executor, importObject ImportObject, dryRun bool) (string, error) {
+	command, result := "", errors.New("unknown error: try importing manually")
 
-		command := fmt.Sprintf("terraform import '%s' '%s'", importObject.targetName, *id)
+	importObject.eachImportId(func(id string) bool {
 		if dryRun {
-			return command, nil
+			command, result = executor.CommandLine("import", "-input=false", importObject.targetName, id), nil
+			return true
 		}
 
-		output, err := executeCommand(command, targetDir)
+		output, err := executor.Import(importObject.targetName, id)
 
 		// How to handle errors
 		// If we can't import by any of our saved properties, we can't delete the state
@@ -49,27 +287,34 @@ func runImport(targetDir string, importObject ImportObject, dryRun bool) (string
 		// If we can't import because we've already imported, return nil
 
 		if err != nil {
-			if strings.Contains(output, "Resource already managed by Terraform") {
-				return "", nil
+			if alreadyManaged(output) {
+				result = nil
+				return true
 			} else if strings.Contains(output, "This resource does not support import.") {
-				return "", errors.New("resource does not implement the import protocol")
+				result = errors.New("resource does not implement the import protocol")
+				return true
 			}
-			continue
-		} else {
-			return "", nil
+			return false
 		}
-	}
-	return "", defaultError
+		result = nil
+		return true
+	})
+	return command, result
 }
 
-func terraformRemoveState(resource string, sourceDir string, dryRun bool) string {
-	command := fmt.Sprintf("terraform state rm '%s'", resource)
+// alreadyManaged tells if an import failed because the address is already in the state,
+// which Terraform and OpenTofu word after themselves
+func alreadyManaged(output string) bool {
+	return strings.Contains(output, "Resource already managed by Terraform") ||
+		strings.Contains(output, "Resource already managed by OpenTofu")
+}
 
-	if !dryRun {
+func terraformRemoveState(resource string, executor Executor, dryRun bool) string {
+	command := executor.CommandLine("state", "rm", resource)
 
-		_, err := executeCommand(command, sourceDir)
-		if err != nil {
-			os.Exit(1)
+	if !dryRun {
+		if err := executor.StateRm(resource); err != nil {
+			Panic(fmt.Sprintf("Failed to remove %s from the state of %s: %v", resource, executor.Dir(), err))
 		}
 	}
 
@@ -0,0 +1,93 @@
+package internal_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingExecutor serves a fixed state and records what it was asked to do
+type recordingExecutor struct {
+	dir     string
+	state   string
+	imports map[string]string
+	removed []string
+}
+
+func (e *recordingExecutor) Dir() string                       { return e.dir }
+func (e *recordingExecutor) CommandLine(args ...string) string { return "" }
+func (e *recordingExecutor) StatePull() (string, error)        { return e.state, nil }
+func (e *recordingExecutor) StatePush(string) error            { return nil }
+func (e *recordingExecutor) StateList() ([]string, error)      { return nil, nil }
+func (e *recordingExecutor) Plan(string, []string) (string, error) {
+	return "", errors.New("not supported")
+}
+func (e *recordingExecutor) Apply(string) (string, error) { return "", errors.New("not supported") }
+func (e *recordingExecutor) Version() (internal.BinaryVersion, error) {
+	return internal.ParseBinaryVersion("Terraform v1.9.0")
+}
+func (e *recordingExecutor) Workspace() string          { return "" }
+func (e *recordingExecutor) EnsureWorkspace(bool) error { return nil }
+
+func (e *recordingExecutor) StateMv(string, string) error { return errors.New("not supported") }
+
+func (e *recordingExecutor) StateRm(address string) error {
+	e.removed = append(e.removed, address)
+	return nil
+}
+
+func (e *recordingExecutor) Import(address string, id string) (string, error) {
+	e.imports[address] = id
+	return "", nil
+}
+
+func TestTerraformExecutor_CommandLine(t *testing.T) {
+	executor := internal.NewTerraformExecutor("terraform", ".")
+	assert.Equal(t, `terraform import -input=false 'aws_ssm_parameter.this["it'\''s"]' /app/value`,
+		executor.CommandLine("import", "-input=false", `aws_ssm_parameter.this["it's"]`, "/app/value"))
+}
+
+func TestRun_Executors(t *testing.T) {
+	source := &recordingExecutor{dir: "source", state: handlerState}
+	target := &recordingExecutor{dir: "target", imports: map[string]string{}}
+
+	internal.Run(internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": `aws_iam_role.this["it's"]`},
+		Strategy:        internal.StrategyImport,
+		SourceExecutor:  source,
+		TargetExecutor:  target,
+	})
+
+	assert.Equal(t, map[string]string{`aws_iam_role.this["it's"]`: "reader"}, target.imports)
+	assert.Equal(t, []string{"aws_iam_role.reader"}, source.removed)
+}
+
+func TestNewTerraformExecutor_Terragrunt(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "terragrunt.hcl"), []byte("terraform {}\n"), 0644))
+
+	executor := internal.NewTerraformExecutor("tofu", dir)
+	assert.Equal(t, internal.BinaryTerragrunt, executor.Binary)
+	assert.Contains(t, executor.Env, "TG_TF_PATH=tofu")
+	assert.Equal(t, "terragrunt state rm aws_iam_role.reader", executor.CommandLine("state", "rm", "aws_iam_role.reader"))
+}
+
+func TestTerraformExecutor_StatePullIgnoresLogs(t *testing.T) {
+	// Terragrunt logs to the standard error while the state goes to the standard output
+	script := filepath.Join(t.TempDir(), "terragrunt")
+	assert.Nil(t, os.WriteFile(script, []byte(`#!/bin/sh
+[ "$TG_TF_PATH" = tofu ] || exit 1
+echo "INFO Downloading source to .terragrunt-cache" >&2
+echo '{"version": 4}'
+`), 0755))
+
+	executor := internal.NewTerragruntExecutor("tofu", t.TempDir())
+	executor.Binary = script
+	state, err := executor.StatePull()
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"version\": 4}\n", state)
+}
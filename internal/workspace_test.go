@@ -0,0 +1,71 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/kassett/tfstate-transfer/internal"
+	"github.com/kassett/tfstate-transfer/internal/faketerraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun_Workspaces(t *testing.T) {
+	fake := faketerraform.New(t)
+	fake.AddObject("aws_iam_role", "reader", nil)
+	dir := fake.WorkingDir("")
+	fake.WorkingDirWorkspace(dir, "staging", runSourceState)
+
+	source := &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: dir, WorkspaceName: "staging"}
+	target := &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: dir, WorkspaceName: "production"}
+	options := internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+		Strategy:        internal.StrategyImport,
+		SourceExecutor:  source,
+		TargetExecutor:  target,
+		CreateWorkspace: true,
+	}
+	internal.Run(options)
+
+	assert.Equal(t, []string{"aws_iam_role.reader"}, fake.WorkspaceAddresses(dir, "production"))
+	assert.ElementsMatch(t, []string{"aws_iam_role.writer", `aws_ssm_parameter.this["it's"]`, `aws_ssm_parameter.this["plain"]`},
+		fake.WorkspaceAddresses(dir, "staging"))
+	// The default workspace was never touched
+	assert.Nil(t, fake.State(dir))
+}
+
+func TestTerraformExecutor_EnsureWorkspace(t *testing.T) {
+	fake := faketerraform.New(t)
+	dir := fake.WorkingDir("")
+	executor := &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: dir, WorkspaceName: "production"}
+
+	assert.NotNil(t, executor.EnsureWorkspace(false))
+	assert.Nil(t, executor.EnsureWorkspace(true))
+	assert.Nil(t, executor.EnsureWorkspace(false))
+
+	executor = &internal.TerraformExecutor{Binary: "terraform", WorkingDir: dir, WorkspaceName: "production"}
+	assert.Equal(t, "TF_WORKSPACE=production terraform state list", executor.CommandLine("state", "list"))
+}
+
+func TestRun_WorkspacesDryRun(t *testing.T) {
+	fake := faketerraform.New(t)
+	dir := fake.WorkingDir("")
+	fake.WorkingDirWorkspace(dir, "staging", runSourceState)
+
+	internal.Run(internal.RunOptions{
+		ResourceMapping: map[string]string{"aws_iam_role.reader": "aws_iam_role.reader"},
+		Strategy:        internal.StrategyStateSurgery,
+		SourceExecutor:  &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: dir, WorkspaceName: "staging"},
+		TargetExecutor:  &internal.TerraformExecutor{Binary: fake.Binary, WorkingDir: dir, WorkspaceName: "production"},
+		CreateWorkspace: true,
+		DryRun:          true,
+	})
+
+	// The target workspace is neither created nor pulled, only the source is
+	pulls := 0
+	for _, call := range fake.Calls() {
+		assert.NotEqual(t, []string{"workspace", "new", "production"}, call.Args)
+		if len(call.Args) == 2 && call.Args[0] == "state" && call.Args[1] == "pull" {
+			pulls++
+		}
+	}
+	assert.Equal(t, 1, pulls)
+}
@@ -12,8 +12,17 @@ var rootCmd = &cobra.Command{
 	Use:   "tfstate-transfer",
 	Short: "A simple CLI tool for transferring resources between Terraform environments.",
 	Run: func(cmd *cobra.Command, args []string) {
-		sourceDir, targetDir, resourceMapping, dryRun := internal.ParseArguments()
-		internal.Run(sourceDir, targetDir, resourceMapping, dryRun)
+		options := internal.ParseArguments()
+		internal.Run(options)
+	},
+}
+
+var pushCmd = &cobra.Command{
+	Use:   "push",
+	Short: "Push staged state files, after checking the live states did not change since they were staged.",
+	Run: func(cmd *cobra.Command, args []string) {
+		options := internal.ParsePushArguments()
+		internal.Push(options)
 	},
 }
 
@@ -23,6 +32,21 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&internal.ConfigFileName, "config-file", "", "Path to the configuration file")
 	rootCmd.PersistentFlags().StringArrayVar(&internal.Resources, "r", []string{}, "List of resources.")
 	rootCmd.PersistentFlags().BoolVar(&internal.DryRun, "dry-run", false, "Perform a dry run without making any changes")
+	rootCmd.PersistentFlags().StringArrayVar(&internal.IdFields, "id-field", []string{}, "Attributes to import resources by, in order, such as tags.Name.")
+	rootCmd.PersistentFlags().StringVar(&internal.Binary, "binary", "", "The binary to run, terraform or tofu (detected in each directory by default)")
+	rootCmd.PersistentFlags().StringVar(&internal.SourceBinary, "source-binary", "", "The binary to run in the source directory")
+	rootCmd.PersistentFlags().StringVar(&internal.TargetBinary, "target-binary", "", "The binary to run in the target directory")
+	rootCmd.PersistentFlags().StringVar(&internal.SourceWorkspace, "source-workspace", "", "The workspace to transfer from (the selected one by default)")
+	rootCmd.PersistentFlags().StringVar(&internal.TargetWorkspace, "target-workspace", "", "The workspace to transfer to (the selected one by default)")
+	rootCmd.PersistentFlags().BoolVar(&internal.CreateWorkspace, "create-workspace", false, "Create the target workspace when it does not exist")
+	rootCmd.PersistentFlags().StringVar(&internal.SourceState, "source-state", "", "A state file, or the output of terraform show -json, to transfer from instead of the source directory")
+	rootCmd.PersistentFlags().StringVar(&internal.TargetState, "target-state", "", "A state file, or the output of terraform show -json, to transfer to instead of the target directory")
+	rootCmd.PersistentFlags().StringVar(&internal.OutDir, "out-dir", "", "Where to write the rewritten states when working on state files")
+	rootCmd.PersistentFlags().StringVar(&internal.Strategy, "strategy", "", "How to transfer the resources: import (default), state-surgery, import-blocks, batch or moved-blocks")
+
+	pushCmd.Flags().StringVar(&internal.SourceStaged, "source", "", "The staged source state (source.tfstate in --out-dir by default)")
+	pushCmd.Flags().StringVar(&internal.TargetStaged, "target", "", "The staged target state (target.tfstate in --out-dir by default)")
+	rootCmd.AddCommand(pushCmd)
 }
 
 func main() {
@@ -203,7 +203,12 @@ func TestCase1(t *testing.T) {
 	configFile := filepath.Join(tempDir, "config.json")
 	configFileContent := internal.OpenConfigFile(configFile)
 	sourceDir, targetDir, _, resourceMapping := internal.UnmarshallConfigFileContent(configFileContent)
-	internal.Run(sourceDir, targetDir, resourceMapping, false)
+	internal.Run(internal.RunOptions{
+		SourceDir:       sourceDir,
+		TargetDir:       targetDir,
+		ResourceMapping: resourceMapping,
+		Strategy:        internal.StrategyImport,
+	})
 
 	sourcePlan, targetPlan := terraformPlanForCase(tempDir)
 
@@ -229,7 +234,12 @@ func TestCase2(t *testing.T) {
 	configFile := filepath.Join(tempDir, "config.json")
 	configFileContent := internal.OpenConfigFile(configFile)
 	sourceDir, targetDir, _, resourceMapping := internal.UnmarshallConfigFileContent(configFileContent)
-	internal.Run(sourceDir, targetDir, resourceMapping, false)
+	internal.Run(internal.RunOptions{
+		SourceDir:       sourceDir,
+		TargetDir:       targetDir,
+		ResourceMapping: resourceMapping,
+		Strategy:        internal.StrategyImport,
+	})
 
 	sourcePlan, targetPlan := terraformPlanForCase(tempDir)
 
@@ -252,7 +262,12 @@ func TestCase3(t *testing.T) {
 	configFile := filepath.Join(tempDir, "config.json")
 	configFileContent := internal.OpenConfigFile(configFile)
 	sourceDir, targetDir, _, resourceMapping := internal.UnmarshallConfigFileContent(configFileContent)
-	internal.Run(sourceDir, targetDir, resourceMapping, false)
+	internal.Run(internal.RunOptions{
+		SourceDir:       sourceDir,
+		TargetDir:       targetDir,
+		ResourceMapping: resourceMapping,
+		Strategy:        internal.StrategyImport,
+	})
 
 	sourcePlan, targetPlan := terraformPlanForCase(tempDir)
 
@@ -274,7 +289,12 @@ func TestCase4(t *testing.T) {
 	configFile := filepath.Join(tempDir, "config.json")
 	configFileContent := internal.OpenConfigFile(configFile)
 	sourceDir, targetDir, _, resourceMapping := internal.UnmarshallConfigFileContent(configFileContent)
-	internal.Run(sourceDir, targetDir, resourceMapping, false)
+	internal.Run(internal.RunOptions{
+		SourceDir:       sourceDir,
+		TargetDir:       targetDir,
+		ResourceMapping: resourceMapping,
+		Strategy:        internal.StrategyImport,
+	})
 
 	sourcePlan, targetPlan := terraformPlanForCase(tempDir)
 
@@ -297,7 +317,12 @@ func TestCase5(t *testing.T) {
 	configFile := filepath.Join(tempDir, "config.json")
 	configFileContent := internal.OpenConfigFile(configFile)
 	sourceDir, targetDir, _, resourceMapping := internal.UnmarshallConfigFileContent(configFileContent)
-	internal.Run(sourceDir, targetDir, resourceMapping, false)
+	internal.Run(internal.RunOptions{
+		SourceDir:       sourceDir,
+		TargetDir:       targetDir,
+		ResourceMapping: resourceMapping,
+		Strategy:        internal.StrategyImport,
+	})
 
 	sourcePlan, targetPlan := terraformPlanForCase(tempDir)
 